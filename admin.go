@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newAdminServer returns the HTTP server exposing the plugin's operational
+// endpoints, and the device inventory when it is not nil. It is not
+// started; see startAdminServer.
+func newAdminServer(log *slog.Logger, addr string, logs *logging, ready *readiness, inventory http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/readyz", ready)
+	mux.Handle("/loglevel", logs)
+	if inventory != nil {
+		mux.Handle("/devices", inventory)
+	}
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{
+		ErrorLog: slog.NewLogLogger(log.Handler(), slog.LevelError),
+	}))
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// startAdminServer serves srv in the background. Errors other than a
+// regular shutdown are logged, as the admin endpoints are not critical to
+// device allocation.
+func startAdminServer(log *slog.Logger, srv *http.Server) {
+	go func() {
+		log.Info("Starting admin server", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Admin server failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoffJitter is the fraction by which each delay is randomly spread, so
+// that plugins restarted together don't retry in lockstep.
+const backoffJitter = 0.2
+
+// backoff computes capped exponential retry delays with jitter. The zero
+// value is not usable; see newBackoff.
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	deadline time.Duration
+
+	attempt int
+	start   time.Time
+	now     func() time.Time
+}
+
+// newBackoff returns a backoff whose delays start at initial and double up
+// to max. Once deadline has elapsed since the first failure Next gives up;
+// a zero deadline retries forever.
+func newBackoff(initial, max, deadline time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, deadline: deadline, now: time.Now}
+}
+
+// Next records a failed attempt and returns how long to wait before the
+// next one, or false when the deadline has passed.
+func (b *backoff) Next() (time.Duration, bool) {
+	if b.attempt == 0 {
+		b.start = b.now()
+	}
+	b.attempt++
+
+	elapsed := b.now().Sub(b.start)
+	if b.deadline > 0 && elapsed >= b.deadline {
+		return 0, false
+	}
+
+	d := b.initial
+	for i := 1; i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	d = min(d, b.max)
+	d = time.Duration(float64(d) * (1 - backoffJitter + 2*backoffJitter*rand.Float64()))
+
+	// Never sleep past the deadline.
+	if b.deadline > 0 {
+		d = min(d, b.deadline-elapsed)
+	}
+	return d, true
+}
+
+// Attempts returns the number of failed attempts since the last Reset.
+func (b *backoff) Attempts() int {
+	return b.attempt
+}
+
+// Elapsed returns the time since the first failed attempt.
+func (b *backoff) Elapsed() time.Duration {
+	if b.attempt == 0 {
+		return 0
+	}
+	return b.now().Sub(b.start)
+}
+
+// Reset forgets previous failures after a successful attempt.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,96 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	b := newBackoff(time.Second, 8*time.Second, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// within reports whether d is base spread by the jitter.
+	within := func(d, base time.Duration) bool {
+		return d >= time.Duration(float64(base)*(1-backoffJitter)) && d <= time.Duration(float64(base)*(1+backoffJitter))
+	}
+
+	// The delays double up to the maximum.
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		d, ok := b.Next()
+		if !ok || !within(d, want) {
+			t.Errorf("attempt %d: Next() = %v, %t, want about %v", i+1, d, ok, want)
+		}
+		now = now.Add(d)
+	}
+	if b.Attempts() != 5 {
+		t.Errorf("Attempts() = %d, want 5", b.Attempts())
+	}
+
+	// The last delay stops at the deadline, after which Next gives up.
+	now = now.Add(time.Minute - b.Elapsed() - 3*time.Second)
+	if d, ok := b.Next(); !ok || d != 3*time.Second {
+		t.Errorf("Next() close to the deadline = %v, %t, want 3s", d, ok)
+	}
+	now = now.Add(3 * time.Second)
+	if _, ok := b.Next(); ok {
+		t.Error("Next() retried past the deadline")
+	}
+
+	// A success starts over, with a new deadline.
+	b.Reset()
+	if b.Elapsed() != 0 {
+		t.Errorf("Elapsed() after Reset = %v, want 0", b.Elapsed())
+	}
+	if d, ok := b.Next(); !ok || !within(d, time.Second) {
+		t.Errorf("Next() after Reset = %v, %t, want about 1s", d, ok)
+	}
+
+	// Without a deadline it retries forever.
+	b = newBackoff(time.Second, 8*time.Second, 0)
+	b.now = func() time.Time { return now }
+	for range 10 {
+		b.Next()
+	}
+	now = now.Add(24 * time.Hour)
+	if d, ok := b.Next(); !ok || !within(d, 8*time.Second) {
+		t.Errorf("Next() without a deadline = %v, %t, want about 8s", d, ok)
+	}
+}
+
+func TestReloadRegistrationBackoff(t *testing.T) {
+	prev := defaultConfig()
+	retry := newBackoff(prev.RegistrationBackoff, prev.RegistrationMaxBackoff, prev.RegistrationDeadline)
+	retry.Next()
+
+	// Other changes keep the failed attempts, and the deadline running.
+	cfg := defaultConfig()
+	cfg.LogLevel, cfg.HealthCheckInterval = "DEBUG", 2*cfg.HealthCheckInterval
+	if got := reloadRegistrationBackoff(retry, prev, cfg); got != retry || got.Attempts() != 1 {
+		t.Errorf("backoff replaced on an unrelated change")
+	}
+
+	cfg.RegistrationMaxBackoff *= 2
+	got := reloadRegistrationBackoff(retry, prev, cfg)
+	if got == retry || got.Attempts() != 0 || got.max != cfg.RegistrationMaxBackoff {
+		t.Errorf("backoff = %+v, want a new one with the maximum %v", got, cfg.RegistrationMaxBackoff)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// kubeletCheckpointFile is the name of the checkpoint of kubelet's device
+// manager in the device plugin directory.
+const kubeletCheckpointFile = "kubelet_internal_checkpoint"
+
+// kubeletCheckpoint is the part of kubelet's device manager checkpoint the
+// plugin reads.
+type kubeletCheckpoint struct {
+	Data struct {
+		PodDeviceEntries []struct {
+			PodUID        string
+			ContainerName string
+			ResourceName  string
+			// DeviceIDs maps NUMA nodes to device IDs since Kubernetes
+			// 1.20 and is a plain list of IDs before.
+			DeviceIDs json.RawMessage
+		}
+	}
+}
+
+// readKubeletCheckpoint returns the containers kubelet assigned the devices
+// of resources under prefix to, by device serial, from its device manager
+// checkpoint at path. The checkpoint only knows pods by UID.
+func readKubeletCheckpoint(path, prefix string) (map[string][]podAssignment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp kubeletCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed parsing kubelet checkpoint %s: %w", path, err)
+	}
+
+	assignments := make(map[string][]podAssignment)
+	for _, e := range cp.Data.PodDeviceEntries {
+		if !strings.HasPrefix(e.ResourceName, prefix) {
+			continue
+		}
+		var ids []string
+		var perNUMA map[string][]string
+		if err := json.Unmarshal(e.DeviceIDs, &perNUMA); err == nil {
+			for _, numaIDs := range perNUMA {
+				ids = append(ids, numaIDs...)
+			}
+		} else if err := json.Unmarshal(e.DeviceIDs, &ids); err != nil {
+			return nil, fmt.Errorf("failed parsing device IDs of pod %s in kubelet checkpoint %s: %w", e.PodUID, path, err)
+		}
+
+		a := podAssignment{PodUID: e.PodUID, Container: e.ContainerName}
+		for _, id := range ids {
+			assignments[id] = append(assignments[id], a)
+		}
+	}
+	return assignments, nil
+}
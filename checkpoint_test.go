@@ -0,0 +1,105 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadKubeletCheckpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		checkpoint string
+		want       map[string][]podAssignment
+	}{
+		{
+			// Since Kubernetes 1.20 the device IDs are grouped by NUMA node.
+			name: "per NUMA node",
+			checkpoint: `{"Data":{"PodDeviceEntries":[
+				{"PodUID":"uid-1","ContainerName":"worker","ResourceName":"habana.ai/gaudi","DeviceIDs":{"0":["A","B"],"1":["C"]},"AllocResp":"CiIKEUhMX1ZJU0lCTEVfREVWSUNFUxINL2Rldi9hY2NlbC8w"},
+				{"PodUID":"uid-2","ContainerName":"sidecar","ResourceName":"habana.ai/gaudi","DeviceIDs":{"-1":["D"]},"AllocResp":""}
+			],"RegisteredDevices":{"habana.ai/gaudi":["A","B","C","D"]}},"Checksum":1234}`,
+			want: map[string][]podAssignment{
+				"A": {{PodUID: "uid-1", Container: "worker"}},
+				"B": {{PodUID: "uid-1", Container: "worker"}},
+				"C": {{PodUID: "uid-1", Container: "worker"}},
+				"D": {{PodUID: "uid-2", Container: "sidecar"}},
+			},
+		},
+		{
+			name: "plain list",
+			checkpoint: `{"Data":{"PodDeviceEntries":[
+				{"PodUID":"uid-1","ContainerName":"worker","ResourceName":"habana.ai/gaudi","DeviceIDs":["A","B"],"AllocResp":""},
+				{"PodUID":"uid-1","ContainerName":"eval","ResourceName":"habana.ai/gaudi","DeviceIDs":["B"],"AllocResp":""}
+			],"RegisteredDevices":{"habana.ai/gaudi":["A","B"]}},"Checksum":1234}`,
+			want: map[string][]podAssignment{
+				"A": {{PodUID: "uid-1", Container: "worker"}},
+				"B": {{PodUID: "uid-1", Container: "worker"}, {PodUID: "uid-1", Container: "eval"}},
+			},
+		},
+		{
+			// The devices of other plugins, e.g. GPUs, are left out.
+			name: "other resources",
+			checkpoint: `{"Data":{"PodDeviceEntries":[
+				{"PodUID":"uid-1","ContainerName":"worker","ResourceName":"nvidia.com/gpu","DeviceIDs":{"0":["GPU-1"]},"AllocResp":""},
+				{"PodUID":"uid-2","ContainerName":"worker","ResourceName":"habana.ai/gaudi2","DeviceIDs":{"0":["A"]},"AllocResp":""}
+			],"RegisteredDevices":{}},"Checksum":1234}`,
+			want: map[string][]podAssignment{
+				"A": {{PodUID: "uid-2", Container: "worker"}},
+			},
+		},
+		{
+			name:       "no assignments",
+			checkpoint: `{"Data":{"PodDeviceEntries":null,"RegisteredDevices":{}},"Checksum":1234}`,
+			want:       map[string][]podAssignment{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), kubeletCheckpointFile)
+			if err := os.WriteFile(path, []byte(tc.checkpoint), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readKubeletCheckpoint(path, "habana.ai/")
+			if err != nil {
+				t.Fatalf("readKubeletCheckpoint() = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("assignments = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadKubeletCheckpointInvalid(t *testing.T) {
+	for _, checkpoint := range []string{
+		`{"Data":`,
+		`{"Data":{"PodDeviceEntries":[{"PodUID":"uid-1","ContainerName":"worker","ResourceName":"habana.ai/gaudi","DeviceIDs":"A"}]}}`,
+	} {
+		path := filepath.Join(t.TempDir(), kubeletCheckpointFile)
+		if err := os.WriteFile(path, []byte(checkpoint), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readKubeletCheckpoint(path, "habana.ai/"); err == nil {
+			t.Errorf("readKubeletCheckpoint(%s) succeeded", checkpoint)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"time"
+)
+
+// ClusterConfig holds the tunables of the commands deployed once per
+// cluster rather than on every node: scheduler-extender, admission-webhook
+// and health-controller. It is resolved like Config, from the defaults,
+// the YAML configuration file, environment variables and command-line
+// flags, but isn't reloaded.
+type ClusterConfig struct {
+	// ConfigFile is the YAML file the configuration was read from.
+	ConfigFile string `yaml:"-"`
+
+	LogLevel  string `yaml:"logLevel"`
+	LogFormat string `yaml:"logFormat"`
+	AdminAddr string `yaml:"adminAddr"`
+
+	// ResourcePrefix is the prefix of the extended resources of the
+	// devices, as advertised by the device plugin.
+	ResourcePrefix string `yaml:"resourcePrefix"`
+	// Kubeconfig is the kubeconfig file used to reach the Kubernetes API.
+	// When empty the in-cluster configuration is used.
+	Kubeconfig string `yaml:"kubeconfig"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// when the command is terminated.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// ExtenderAddr is the listen address of the scheduler extender served
+	// by the scheduler-extender command. With ExtenderRequireContiguous it
+	// filters out the nodes whose free modules aren't contiguous.
+	ExtenderAddr              string `yaml:"extenderAddr"`
+	ExtenderRequireContiguous bool   `yaml:"extenderRequireContiguous"`
+	// WebhookAddr is the listen address of the admission webhooks served
+	// over TLS by the admission-webhook command. They deny pods requesting
+	// a number of devices per container other than WebhookAllowedCounts,
+	// more than WebhookMaxDevices per pod, or without the node selectors
+	// of WebhookNodeSelector, in the key[=value] form. They set missing
+	// device limits to the requests with WebhookSetLimits, and add the
+	// WebhookEnv variables, as NAME=value, and WebhookTolerations, as
+	// key[=value]:effect. The lists are comma-separated.
+	WebhookAddr          string `yaml:"webhookAddr"`
+	WebhookCertFile      string `yaml:"webhookCertFile"`
+	WebhookKeyFile       string `yaml:"webhookKeyFile"`
+	WebhookAllowedCounts string `yaml:"webhookAllowedCounts"`
+	WebhookMaxDevices    int    `yaml:"webhookMaxDevices"`
+	WebhookNodeSelector  string `yaml:"webhookNodeSelector"`
+	WebhookSetLimits     bool   `yaml:"webhookSetLimits"`
+	WebhookEnv           string `yaml:"webhookEnv"`
+	WebhookTolerations   string `yaml:"webhookTolerations"`
+}
+
+// defaultClusterConfig returns the cluster configuration used when nothing
+// is overridden.
+func defaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		LogLevel:             slog.LevelInfo.String(),
+		LogFormat:            logFormatJSON,
+		AdminAddr:            ":8080",
+		ResourcePrefix:       "habana.ai/",
+		ShutdownTimeout:      10 * time.Second,
+		ExtenderAddr:         ":8888",
+		WebhookAddr:          ":8443",
+		WebhookAllowedCounts: "1,2,4,8",
+	}
+}
+
+// bindFlags registers a flag for every configuration value on fs, using
+// the current values of c as defaults.
+func (c *ClusterConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "path to the YAML configuration file")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "initial log level of every subsystem")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output format, json or text")
+	fs.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "listen address of the admin and metrics HTTP server, empty to disable")
+	fs.StringVar(&c.ResourcePrefix, "resource-prefix", c.ResourcePrefix, "prefix of the extended resource names of the devices")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "kubeconfig file to reach the Kubernetes API, empty to use the in-cluster configuration")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long in-flight requests may take to finish on shutdown")
+	fs.StringVar(&c.ExtenderAddr, "extender-addr", c.ExtenderAddr, "listen address of the scheduler extender")
+	fs.BoolVar(&c.ExtenderRequireContiguous, "extender-require-contiguous", c.ExtenderRequireContiguous, "filter out the nodes whose free modules don't fit the requested devices contiguously")
+	fs.StringVar(&c.WebhookAddr, "webhook-addr", c.WebhookAddr, "listen address of the admission webhooks")
+	fs.StringVar(&c.WebhookCertFile, "webhook-cert-file", c.WebhookCertFile, "TLS certificate of the admission webhooks")
+	fs.StringVar(&c.WebhookKeyFile, "webhook-key-file", c.WebhookKeyFile, "TLS key of the admission webhooks")
+	fs.StringVar(&c.WebhookAllowedCounts, "webhook-allowed-counts", c.WebhookAllowedCounts, "comma-separated numbers of devices a container may request, empty to allow any")
+	fs.IntVar(&c.WebhookMaxDevices, "webhook-max-devices", c.WebhookMaxDevices, "maximum number of devices a pod may request, 0 for no limit")
+	fs.StringVar(&c.WebhookNodeSelector, "webhook-node-selector", c.WebhookNodeSelector, "comma-separated node selectors, as key[=value], pods requesting devices must set")
+	fs.BoolVar(&c.WebhookSetLimits, "webhook-set-limits", c.WebhookSetLimits, "set the missing device limits of containers to their requests")
+	fs.StringVar(&c.WebhookEnv, "webhook-env", c.WebhookEnv, "comma-separated environment variables, as NAME=value, added to containers requesting devices")
+	fs.StringVar(&c.WebhookTolerations, "webhook-tolerations", c.WebhookTolerations, "comma-separated tolerations, as key[=value]:effect, added to pods requesting devices")
+}
+
+func (c *ClusterConfig) configFile() *string { return &c.ConfigFile }
+
+// loadClusterConfig resolves the cluster configuration like loadConfig.
+func loadClusterConfig(name string, args []string) (*ClusterConfig, []string, error) {
+	return resolveConfig(name, args, defaultClusterConfig, nil)
+}
+
+func (c *ClusterConfig) validate() error {
+	errs := validateCommon(c.LogLevel, c.LogFormat, c.ResourcePrefix)
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdownTimeout: must be positive"))
+	}
+	if _, err := newAdmissionRules(c); err != nil {
+		errs = append(errs, err)
+	}
+	if c.WebhookMaxDevices < 0 {
+		errs = append(errs, errors.New("webhookMaxDevices: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,478 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Output formats of the inspection commands.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// command is a subcommand of the plugin binary.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(name string, args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "run the device plugin and register it with kubelet (default)", serveCommand},
+	{"dra", "", "run as a Dynamic Resource Allocation kubelet plugin", draCommand},
+	{"scheduler-extender", "", "serve a scheduler extender scoring nodes by their free device modules", clusterCommand(newSchedulerExtenderService)},
+	{"admission-webhook", "", "serve admission webhooks validating and mutating pods requesting devices", clusterCommand(newAdmissionWebhookService)},
+	{"health-controller", "", "aggregate the health of the Habana devices of the cluster", clusterCommand(newHealthControllerService)},
+	{"discover", "", "print the devices the plugin would advertise", discoverCommand},
+	{"inspect-allocate", "<device-id>...", "print the device specs and environment Allocate would return", inspectAllocateCommand},
+	{"version", "", "print the plugin, HLML and driver versions", versionCommand},
+}
+
+// runCommand runs the subcommand named by args[0] and returns the process
+// exit code. Without a subcommand, or when args start with a flag, the
+// plugin is served for compatibility with existing deployments.
+func runCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		err := c.run(c.name, args)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		case errors.Is(err, errReported):
+			return 1
+		default:
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return 2
+}
+
+var (
+	// errUsage is returned by commands invoked with invalid flags or
+	// arguments, which have already been reported.
+	errUsage = errors.New("invalid usage")
+	// errReported is returned by commands that failed and already logged
+	// why.
+	errReported = errors.New("command failed")
+)
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// loadCommandConfig loads the configuration of a command, reporting flag
+// errors to stderr.
+func loadCommandConfig(name string, args []string, extra func(fs *flag.FlagSet)) (*Config, []string, error) {
+	cfg, rest, err := loadConfig(name, args, extra)
+	return cfg, rest, usageError(err)
+}
+
+// usageError reports err to stderr and returns errUsage in its place,
+// unless it is nil or a request for help.
+func usageError(err error) error {
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+	return err
+}
+
+func serveCommand(name string, args []string) error {
+	cfg, _, err := loadCommandConfig(name, args, nil)
+	if err != nil {
+		return err
+	}
+
+	logs, err := setup(cfg, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	log := logs.Logger()
+	load := func() (*Config, error) {
+		cfg, _, err := loadConfig(name, args, nil)
+		return cfg, err
+	}
+	if err := run(log, logs, cfg, load); err != nil {
+		log.Error(err.Error())
+		return errReported
+	}
+	return nil
+}
+
+func draCommand(name string, args []string) error {
+	cfg, _, err := loadCommandConfig(name, args, nil)
+	if err != nil {
+		return err
+	}
+
+	logs, err := setup(cfg, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	log := logs.Logger()
+	if err := runDRA(log, logs, cfg); err != nil {
+		log.Error(err.Error())
+		return errReported
+	}
+	return nil
+}
+
+// clusterService is what a cluster command runs: an HTTP handler served
+// on addr, over TLS when tlsConfig is set, and background work.
+type clusterService struct {
+	// name names the service in logs, e.g. scheduler extender.
+	name      string
+	addr      string
+	handler   http.Handler
+	tlsConfig *tls.Config
+	// status, when set, is served by the admin server on /devices.
+	status http.Handler
+	// sync, when set, waits for the caches the service reads to sync. The
+	// command isn't ready until then.
+	sync func(ctx context.Context) error
+	// run, when set, runs in the background until ctx is done.
+	run func(ctx context.Context)
+}
+
+// clusterCommand returns a command deployed once per cluster, which
+// serves what newService returns for its ClusterConfig until a signal
+// stops it.
+func clusterCommand(newService func(log *slog.Logger, cfg *ClusterConfig, clients *kubeClients) (*clusterService, error)) func(name string, args []string) error {
+	return func(name string, args []string) error {
+		cfg, _, err := loadClusterConfig(name, args)
+		if err := usageError(err); err != nil {
+			return err
+		}
+
+		logs, err := initLogger(os.Stdout, cfg.LogFormat, cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+
+		log := logs.Logger()
+		if err := runClusterService(log, logs, cfg, newService); err != nil {
+			log.Error(err.Error())
+			return errReported
+		}
+		return nil
+	}
+}
+
+func runClusterService(log *slog.Logger, logs *logging, cfg *ClusterConfig, newService func(log *slog.Logger, cfg *ClusterConfig, clients *kubeClients) (*clusterService, error)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	defer func() {
+		cancel()
+		background.Wait()
+	}()
+
+	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Info("Received OS signal. Shutting down", "signal", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	svc, err := newService(log, cfg, &kubeClients{kubeconfig: cfg.Kubeconfig})
+	if err != nil {
+		return err
+	}
+	if svc.handler != nil {
+		log.Info("Started Habana "+svc.name, "version", build, "addr", svc.addr)
+	} else {
+		log.Info("Started Habana "+svc.name, "version", build)
+	}
+
+	ready := newReadiness()
+	if cfg.AdminAddr != "" {
+		adminServer := newAdminServer(log, cfg.AdminAddr, logs, ready, svc.status)
+		startAdminServer(log, adminServer)
+		defer adminServer.Close()
+	}
+
+	var srv *http.Server
+	serveErr := make(chan error, 1)
+	if svc.handler != nil {
+		srv = &http.Server{
+			Addr:              svc.addr,
+			Handler:           svc.handler,
+			ReadHeaderTimeout: 5 * time.Second,
+			TLSConfig:         svc.tlsConfig,
+		}
+		go func() {
+			if srv.TLSConfig != nil {
+				serveErr <- srv.ListenAndServeTLS("", "")
+			} else {
+				serveErr <- srv.ListenAndServe()
+			}
+		}()
+	}
+
+	if svc.sync != nil {
+		ready.Set(stateRegistering, "waiting for the caches to sync")
+		if err := svc.sync(ctx); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() == nil {
+		ready.Set(stateRegistered, "")
+	}
+	if svc.run != nil {
+		background.Go(func() { svc.run(ctx) })
+	}
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("failed serving %s: %w", svc.name, err)
+	case <-ctx.Done():
+	}
+	ready.Set(stateStopping, "")
+	if srv != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancelShutdown()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warn("Stopped "+svc.name+" before in-flight requests finished", "error", err)
+		}
+	}
+	return nil
+}
+
+// withHLML initializes HLML and the device plugin for the inspection
+// commands, logging to stderr so that stdout only carries the result.
+func withHLML(cfg *Config, fn func(plugin *HabanalabsDevicePlugin) error) error {
+	logs, err := setup(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	if err := hlml.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize HLML: %w", err)
+	}
+	defer func() { _ = hlml.Shutdown() }()
+
+	dev, err := hlml.GetDeviceTypeName()
+	if err != nil {
+		return fmt.Errorf("failed detecting Habana's devices on the system: %w", err)
+	}
+
+	plugin := NewHabanalabsDevicePlugin(
+		logs,
+		NewDeviceManager(logs.For(subsystemDiscovery), strings.ToUpper(dev)),
+		cfg.ResourceName(dev),
+		cfg.PluginSocket(dev),
+		cfg.RegistrationSocket(dev),
+		cfg,
+	)
+	if err := plugin.loadDevices(context.Background()); err != nil {
+		return fmt.Errorf("failed discovering devices: %w", err)
+	}
+	return fn(plugin)
+}
+
+func outputFlag(output *string) func(fs *flag.FlagSet) {
+	return func(fs *flag.FlagSet) {
+		fs.StringVar(output, "output", outputTable, "output format, table or json")
+	}
+}
+
+func checkOutput(output string) error {
+	if output != outputTable && output != outputJSON {
+		fmt.Fprintf(os.Stderr, "unsupported output format %q, expected %q or %q\n", output, outputTable, outputJSON)
+		return errUsage
+	}
+	return nil
+}
+
+func discoverCommand(name string, args []string) error {
+	var output string
+	cfg, _, err := loadCommandConfig(name, args, outputFlag(&output))
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+
+	return withHLML(cfg, func(plugin *HabanalabsDevicePlugin) error {
+		if output == outputJSON {
+			return writeJSON(os.Stdout, struct {
+				ResourceName string              `json:"resourceName"`
+				Devices      []*pluginapi.Device `json:"devices"`
+			}{plugin.resourceName, plugin.devices()})
+		}
+
+		fmt.Printf("Resource: %s\n\n", plugin.resourceName)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tHEALTH\tNUMA NODE")
+		for _, d := range plugin.devices() {
+			numa := "-"
+			if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+				numa = fmt.Sprint(d.Topology.Nodes[0].ID)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", d.ID, d.Health, numa)
+		}
+		return tw.Flush()
+	})
+}
+
+func inspectAllocateCommand(name string, args []string) error {
+	var output string
+	cfg, ids, err := loadCommandConfig(name, args, outputFlag(&output))
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags] <device-id>...\n", os.Args[0], name)
+		return errUsage
+	}
+	return withHLML(cfg, func(plugin *HabanalabsDevicePlugin) error {
+		resp, err := plugin.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIds: ids}},
+		})
+		if err != nil {
+			return err
+		}
+		car := resp.ContainerResponses[0]
+
+		if output == outputJSON {
+			return writeJSON(os.Stdout, car)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST PATH\tCONTAINER PATH\tPERMISSIONS")
+		for _, d := range car.Devices {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", d.HostPath, d.ContainerPath, d.Permissions)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Println()
+		keys := make([]string, 0, len(car.Envs))
+		for k := range car.Envs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s=%s\n", k, car.Envs[k])
+		}
+		return nil
+	})
+}
+
+func versionCommand(name string, args []string) error {
+	cfg, _, err := loadCommandConfig(name, args, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := setup(cfg, io.Discard); err != nil {
+		return err
+	}
+
+	fmt.Printf("Version:         %s\n", build)
+	fmt.Printf("Go version:      %s\n", runtime.Version())
+	fmt.Printf("HLML bindings:   %s\n", hlmlBindingsVersion())
+
+	// The driver version needs HLML, which may be missing where the
+	// command is run; report it rather than failing.
+	driver := "unavailable"
+	if err := hlml.Initialize(); err == nil {
+		if v, err := hlml.SystemDriverVersion(); err == nil {
+			driver = v
+		}
+		_ = hlml.Shutdown()
+	}
+	fmt.Printf("Driver version:  %s\n", driver)
+	return nil
+}
+
+// hlmlBindingsVersion returns the version of the gohlml module the binary
+// was built with.
+func hlmlBindingsVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, m := range info.Deps {
+		if m.Path == "github.com/HabanaAI/gohlml" {
+			return m.Version
+		}
+	}
+	return "not linked"
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,525 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Config holds every tunable of the device plugin and the other commands
+// run on the nodes. The commands run once per cluster have their own
+// ClusterConfig.
+//
+// Values are resolved in increasing order of precedence from the defaults,
+// the YAML configuration file, environment variables and command-line
+// flags. Every flag has an environment variable named after it, upper-cased
+// with dashes replaced by underscores, e.g. --log-level and LOG_LEVEL.
+//
+// Reloading the configuration applies changes in place, except to the
+// fields tagged reload:"plugin", which restart the device plugin, and
+// reload:"process", which are kept until the process restarts.
+type Config struct {
+	// ConfigFile is the YAML file the configuration was read from.
+	ConfigFile string `yaml:"-"`
+
+	LogLevel        string `yaml:"logLevel"`
+	LogFormat       string `yaml:"logFormat" reload:"process"`
+	AdminAddr       string `yaml:"adminAddr" reload:"process"`
+	TracingEndpoint string `yaml:"tracingEndpoint" reload:"process"`
+
+	// ResourcePrefix is prepended to the device type to form the extended
+	// resource name, e.g. habana.ai/gaudi.
+	ResourcePrefix string `yaml:"resourcePrefix" reload:"plugin"`
+	// DevicePluginPath is the kubelet device plugin directory holding both
+	// the kubelet socket and the plugin socket.
+	DevicePluginPath string `yaml:"devicePluginPath" reload:"plugin"`
+	// RegistrationMode selects how the plugin registers with kubelet:
+	// actively through the kubelet socket, or by serving the plugin
+	// registration service in PluginsRegistryPath for kubelet to discover.
+	RegistrationMode    string `yaml:"registrationMode" reload:"plugin"`
+	PluginsRegistryPath string `yaml:"pluginsRegistryPath" reload:"plugin"`
+	// NFDFeaturesPath is the Node Feature Discovery features.d directory the
+	// device features are written to as node labels. Empty disables it.
+	NFDFeaturesPath string `yaml:"nfdFeaturesPath"`
+	// DeviceAllowList and DeviceDenyList are comma-separated serial numbers
+	// and module IDs of the devices advertised, all of them when the allow
+	// list is empty, and of those hidden from kubelet.
+	DeviceAllowList string `yaml:"deviceAllowList"`
+	DeviceDenyList  string `yaml:"deviceDenyList"`
+	// AllocateEnv is a comma-separated list of environment variables, as
+	// NAME=template, added to the containers devices are allocated to. The
+	// templates are Go text/template rendered with the allocated devices.
+	AllocateEnv string `yaml:"allocateEnv"`
+
+	// NodeName is the name of the node the plugin runs on, needed by the
+	// features using the Kubernetes API.
+	NodeName string `yaml:"nodeName" reload:"process"`
+	// Kubeconfig is the kubeconfig file used to reach the Kubernetes API.
+	// When empty the in-cluster configuration is used.
+	Kubeconfig string `yaml:"kubeconfig" reload:"process"`
+	// NodeLabels makes the plugin label its Node object with the features
+	// and health of the devices, as an alternative to Node Feature
+	// Discovery.
+	NodeLabels bool `yaml:"nodeLabels" reload:"process"`
+	// HealthEvents makes the plugin record Kubernetes Events on the Node
+	// when a device changes health.
+	HealthEvents bool `yaml:"healthEvents" reload:"process"`
+	// PodResourcesSocket is kubelet's PodResources API socket, polled every
+	// PodResourcesInterval to learn which containers use the devices.
+	// Empty disables it.
+	PodResourcesSocket   string        `yaml:"podResourcesSocket" reload:"process"`
+	PodResourcesInterval time.Duration `yaml:"podResourcesInterval" reload:"process"`
+	// FailedDeviceActions is a comma-separated list of reactions to a
+	// device failing under a running pod, among annotate, event and evict.
+	// Pods are found through the PodResources API. At most MaxEvictions
+	// pods are evicted every EvictionInterval.
+	FailedDeviceActions string        `yaml:"failedDeviceActions" reload:"process"`
+	MaxEvictions        int           `yaml:"maxEvictions" reload:"process"`
+	EvictionInterval    time.Duration `yaml:"evictionInterval" reload:"process"`
+	// NodeCondition makes the plugin set the HabanaDevicesHealthy condition
+	// of the Node, and UnhealthyTaint, in the key[=value]:effect form, is
+	// applied to the Node when set. The condition turns false and the
+	// taint is applied while at least UnhealthyThreshold devices are
+	// unhealthy.
+	NodeCondition      bool   `yaml:"nodeCondition" reload:"process"`
+	UnhealthyTaint     string `yaml:"unhealthyTaint" reload:"process"`
+	UnhealthyThreshold int    `yaml:"unhealthyThreshold"`
+	// NodeResourceTopology makes the plugin publish the NUMA topology of
+	// the devices as a NodeResourceTopology for topology-aware scheduling,
+	// along with kubelet's TopologyManagerPolicy, if set, and
+	// TopologyManagerScope.
+	NodeResourceTopology  bool   `yaml:"nodeResourceTopology" reload:"process"`
+	TopologyManagerPolicy string `yaml:"topologyManagerPolicy" reload:"process"`
+	TopologyManagerScope  string `yaml:"topologyManagerScope" reload:"process"`
+	// ModuleAnnotations makes the plugin annotate its Node with the module
+	// IDs of the devices and of the free ones, for the scheduler extender.
+	ModuleAnnotations bool `yaml:"moduleAnnotations" reload:"process"`
+	// DeviceObjects makes the plugin keep a HabanaDevice object per device
+	// up to date with its identifiers, health and pods, aggregated by the
+	// health-controller command.
+	DeviceObjects bool `yaml:"deviceObjects" reload:"process"`
+
+	// DRADriverName is the name of the Dynamic Resource Allocation driver,
+	// used by the dra command, which serves kubelet in a directory named
+	// after it under KubeletPluginsPath. CDIRoot is the host directory the
+	// container runtime reads CDI specs from, prepared claims are written
+	// there.
+	DRADriverName      string `yaml:"draDriverName"`
+	KubeletPluginsPath string `yaml:"kubeletPluginsPath"`
+	CDIRoot            string `yaml:"cdiRoot"`
+	// HostRoot is where the host's root filesystem is mounted in the
+	// plugin's container. All sysfs and devfs reads go through it, while
+	// paths handed to kubelet stay relative to the host.
+	HostRoot string `yaml:"hostRoot"`
+	// DevicePath is the host directory of the accel device nodes.
+	DevicePath string `yaml:"devicePath"`
+	// PCIDevicesPath is the host sysfs directory of PCI devices.
+	PCIDevicesPath string `yaml:"pciDevicesPath"`
+
+	KubeletDialTimeout time.Duration `yaml:"kubeletDialTimeout"`
+	// Registration with kubelet is retried with exponential backoff from
+	// RegistrationBackoff up to RegistrationMaxBackoff, and abandoned once
+	// RegistrationDeadline has passed. A zero deadline retries forever.
+	RegistrationBackoff    time.Duration `yaml:"registrationBackoff"`
+	RegistrationMaxBackoff time.Duration `yaml:"registrationMaxBackoff"`
+	RegistrationDeadline   time.Duration `yaml:"registrationDeadline"`
+	// RegistrationCheckInterval is how often the registration with kubelet
+	// is verified, to catch kubelet restarts missed by the socket watcher.
+	RegistrationCheckInterval time.Duration `yaml:"registrationCheckInterval"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// when the plugin is terminated.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// DevicePollInterval is how often devices are looked for while none
+	// are present, on top of watching devfs and sysfs.
+	DevicePollInterval  time.Duration `yaml:"devicePollInterval"`
+	HealthCheckInterval time.Duration `yaml:"healthCheckInterval"`
+	// EventWaitTimeout bounds each HLML WaitForEvent call of the health
+	// check.
+	EventWaitTimeout time.Duration `yaml:"eventWaitTimeout"`
+}
+
+// defaultConfig returns the configuration used when nothing is overridden.
+func defaultConfig() *Config {
+	return &Config{
+		LogLevel:                  slog.LevelInfo.String(),
+		LogFormat:                 logFormatJSON,
+		AdminAddr:                 ":8080",
+		ResourcePrefix:            "habana.ai/",
+		DevicePluginPath:          pluginapi.DevicePluginPath,
+		RegistrationMode:          registrationModeKubelet,
+		PluginsRegistryPath:       "/var/lib/kubelet/plugins_registry",
+		NFDFeaturesPath:           "/etc/kubernetes/node-feature-discovery/features.d",
+		UnhealthyThreshold:        1,
+		PodResourcesInterval:      10 * time.Second,
+		MaxEvictions:              1,
+		EvictionInterval:          10 * time.Minute,
+		TopologyManagerScope:      "container",
+		DRADriverName:             "habana.ai",
+		KubeletPluginsPath:        "/var/lib/kubelet/plugins",
+		CDIRoot:                   "/var/run/cdi",
+		HostRoot:                  "/",
+		DevicePath:                "/dev/accel",
+		PCIDevicesPath:            "/sys/bus/pci/devices",
+		KubeletDialTimeout:        5 * time.Second,
+		RegistrationBackoff:       time.Second,
+		RegistrationMaxBackoff:    time.Minute,
+		RegistrationDeadline:      15 * time.Minute,
+		RegistrationCheckInterval: 30 * time.Second,
+		ShutdownTimeout:           10 * time.Second,
+		DevicePollInterval:        30 * time.Second,
+		HealthCheckInterval:       10 * time.Second,
+		EventWaitTimeout:          time.Second,
+	}
+}
+
+// bindFlags registers a flag for every configuration value on fs, using
+// the current values of c as defaults.
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "path to the YAML configuration file")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "initial log level of every subsystem")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output format, json or text")
+	fs.StringVar(&c.AdminAddr, "admin-addr", c.AdminAddr, "listen address of the admin and metrics HTTP server, empty to disable")
+	fs.StringVar(&c.TracingEndpoint, "tracing-endpoint", c.TracingEndpoint, "OTLP/gRPC endpoint traces are exported to, empty to disable tracing")
+	fs.StringVar(&c.ResourcePrefix, "resource-prefix", c.ResourcePrefix, "prefix of the extended resource name advertised to kubelet")
+	fs.StringVar(&c.DevicePluginPath, "device-plugin-path", c.DevicePluginPath, "kubelet device plugin directory")
+	fs.StringVar(&c.RegistrationMode, "registration-mode", c.RegistrationMode, "how to register with kubelet, kubelet to register through the kubelet socket or pluginwatcher to be discovered in the plugins registry")
+	fs.StringVar(&c.NFDFeaturesPath, "nfd-features-path", c.NFDFeaturesPath, "Node Feature Discovery features.d directory device features are written to, empty to disable")
+	fs.StringVar(&c.DeviceAllowList, "device-allow-list", c.DeviceAllowList, "comma-separated serial numbers and module IDs of the devices advertised, empty for all")
+	fs.StringVar(&c.DeviceDenyList, "device-deny-list", c.DeviceDenyList, "comma-separated serial numbers and module IDs of the devices not advertised")
+	fs.StringVar(&c.AllocateEnv, "allocate-env", c.AllocateEnv, "comma-separated environment variables, as NAME=template, added to containers devices are allocated to")
+	fs.StringVar(&c.NodeName, "node-name", c.NodeName, "name of the node the plugin runs on")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "kubeconfig file to reach the Kubernetes API, empty to use the in-cluster configuration")
+	fs.BoolVar(&c.NodeLabels, "node-labels", c.NodeLabels, "label the node with the features and health of the devices through the Kubernetes API")
+	fs.BoolVar(&c.HealthEvents, "health-events", c.HealthEvents, "record Kubernetes Events on the node when a device changes health")
+	fs.StringVar(&c.PodResourcesSocket, "pod-resources-socket", c.PodResourcesSocket, "kubelet PodResources API socket used to learn which containers use the devices, empty to disable")
+	fs.DurationVar(&c.PodResourcesInterval, "pod-resources-interval", c.PodResourcesInterval, "interval between listings of the PodResources API")
+	fs.StringVar(&c.FailedDeviceActions, "failed-device-actions", c.FailedDeviceActions, "comma-separated reactions to a device failing under a running pod: annotate, event, evict")
+	fs.IntVar(&c.MaxEvictions, "max-evictions", c.MaxEvictions, "maximum number of pods evicted every eviction interval")
+	fs.DurationVar(&c.EvictionInterval, "eviction-interval", c.EvictionInterval, "interval the maximum number of evictions applies to")
+	fs.BoolVar(&c.NodeCondition, "node-condition", c.NodeCondition, "set the HabanaDevicesHealthy condition of the node")
+	fs.StringVar(&c.UnhealthyTaint, "unhealthy-taint", c.UnhealthyTaint, "taint applied to the node while devices are unhealthy, as key[=value]:effect, empty to disable")
+	fs.IntVar(&c.UnhealthyThreshold, "unhealthy-threshold", c.UnhealthyThreshold, "number of unhealthy devices from which the node condition fails and the taint is applied")
+	fs.BoolVar(&c.NodeResourceTopology, "node-resource-topology", c.NodeResourceTopology, "publish the NUMA topology of the devices as a NodeResourceTopology")
+	fs.StringVar(&c.TopologyManagerPolicy, "topology-manager-policy", c.TopologyManagerPolicy, "kubelet's topology manager policy published in the NodeResourceTopology, empty to leave it out")
+	fs.StringVar(&c.TopologyManagerScope, "topology-manager-scope", c.TopologyManagerScope, "kubelet's topology manager scope published in the NodeResourceTopology")
+	fs.BoolVar(&c.ModuleAnnotations, "module-annotations", c.ModuleAnnotations, "annotate the node with the module IDs of the devices and of the free ones, for the scheduler extender")
+	fs.BoolVar(&c.DeviceObjects, "device-objects", c.DeviceObjects, "keep a HabanaDevice object per device up to date with its health and pods")
+	fs.StringVar(&c.DRADriverName, "dra-driver-name", c.DRADriverName, "name of the Dynamic Resource Allocation driver")
+	fs.StringVar(&c.KubeletPluginsPath, "kubelet-plugins-path", c.KubeletPluginsPath, "kubelet plugins directory the DRA driver serves kubelet in")
+	fs.StringVar(&c.CDIRoot, "cdi-root", c.CDIRoot, "directory CDI specs of prepared resource claims are written to")
+	fs.StringVar(&c.PluginsRegistryPath, "plugins-registry-path", c.PluginsRegistryPath, "kubelet plugins registry directory, used in pluginwatcher registration mode")
+	fs.StringVar(&c.HostRoot, "host-root", c.HostRoot, "mount point of the host root filesystem, sysfs and devfs are read through it")
+	fs.StringVar(&c.DevicePath, "device-path", c.DevicePath, "host directory of the accel device nodes")
+	fs.StringVar(&c.PCIDevicesPath, "pci-devices-path", c.PCIDevicesPath, "host sysfs directory of PCI devices")
+	fs.DurationVar(&c.KubeletDialTimeout, "kubelet-dial-timeout", c.KubeletDialTimeout, "timeout for connecting to the kubelet and plugin sockets")
+	fs.DurationVar(&c.RegistrationBackoff, "registration-backoff", c.RegistrationBackoff, "initial delay between attempts to register with kubelet")
+	fs.DurationVar(&c.RegistrationMaxBackoff, "registration-max-backoff", c.RegistrationMaxBackoff, "maximum delay between attempts to register with kubelet")
+	fs.DurationVar(&c.RegistrationDeadline, "registration-deadline", c.RegistrationDeadline, "how long to keep retrying registration with kubelet before exiting, 0 to retry forever")
+	fs.DurationVar(&c.RegistrationCheckInterval, "registration-check-interval", c.RegistrationCheckInterval, "interval between checks that the registration with kubelet is still valid")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long in-flight requests may take to finish on shutdown")
+	fs.DurationVar(&c.DevicePollInterval, "device-poll-interval", c.DevicePollInterval, "interval between checks for devices while none are present")
+	fs.DurationVar(&c.HealthCheckInterval, "health-check-interval", c.HealthCheckInterval, "interval between device health checks")
+	fs.DurationVar(&c.EventWaitTimeout, "event-wait-timeout", c.EventWaitTimeout, "how long each health check waits for HLML events")
+}
+
+// commandConfig is the configuration of a set of commands, resolved by
+// resolveConfig: Config for the node agent and ClusterConfig for the
+// commands deployed once per cluster.
+type commandConfig interface {
+	bindFlags(fs *flag.FlagSet)
+	validate() error
+	// configFile returns where the path of the configuration file is held.
+	configFile() *string
+}
+
+func (c *Config) configFile() *string { return &c.ConfigFile }
+
+// loadConfig resolves the configuration of the node agent from the
+// defaults, the configuration file, the environment and args, then
+// validates it. extra, when not nil, registers command specific flags that
+// are not part of the configuration. The positional arguments left after
+// the flags are returned.
+func loadConfig(name string, args []string, extra func(fs *flag.FlagSet)) (*Config, []string, error) {
+	return resolveConfig(name, args, defaultConfig, extra)
+}
+
+// resolveConfig resolves a configuration of defaults as described by
+// loadConfig.
+func resolveConfig[C commandConfig](name string, args []string, defaults func() C, extra func(fs *flag.FlagSet)) (C, []string, error) {
+	var none C
+
+	// The first pass only locates the configuration file, which must be
+	// loaded before the environment and flags are applied on top of it.
+	probe := defaults()
+	*probe.configFile() = os.Getenv("CONFIG")
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	probe.bindFlags(fs)
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return none, nil, err
+	}
+
+	cfg := defaults()
+	path := *probe.configFile()
+	if path != "" {
+		if err := readConfigFile(path, cfg); err != nil {
+			return none, nil, err
+		}
+	}
+	*cfg.configFile() = path
+
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg.bindFlags(fs)
+	if err := applyEnv(fs); err != nil {
+		return none, nil, err
+	}
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return none, nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return none, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readConfigFile overrides cfg with the values set in the YAML file at
+// path. Unknown keys are rejected to catch typos.
+func readConfigFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets every flag of fs from its environment variable, if present.
+func applyEnv(fs *flag.FlagSet) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		key := envName(f.Name)
+		if v, ok := os.LookupEnv(key); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", v, key, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// envName returns the environment variable backing the flag name.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+var (
+	resourcePrefixRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?/$`)
+	driverNameRe     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+)
+
+// validateCommon checks the values every command shares.
+func validateCommon(logLevel, logFormat, resourcePrefix string) []error {
+	var errs []error
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(logLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %w", err))
+	}
+	if logFormat != logFormatJSON && logFormat != logFormatText {
+		errs = append(errs, fmt.Errorf("logFormat: must be %q or %q, got %q", logFormatJSON, logFormatText, logFormat))
+	}
+	if !resourcePrefixRe.MatchString(resourcePrefix) {
+		errs = append(errs, fmt.Errorf("resourcePrefix: must be a DNS subdomain followed by '/', got %q", resourcePrefix))
+	}
+	return errs
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	errs = append(errs, validateCommon(c.LogLevel, c.LogFormat, c.ResourcePrefix)...)
+	if c.RegistrationMode != registrationModeKubelet && c.RegistrationMode != registrationModePluginWatcher {
+		errs = append(errs, fmt.Errorf("registrationMode: must be %q or %q, got %q", registrationModeKubelet, registrationModePluginWatcher, c.RegistrationMode))
+	}
+	for _, p := range []struct{ name, path string }{
+		{"devicePluginPath", c.DevicePluginPath},
+		{"pluginsRegistryPath", c.PluginsRegistryPath},
+		{"kubeletPluginsPath", c.KubeletPluginsPath},
+		{"cdiRoot", c.CDIRoot},
+		{"hostRoot", c.HostRoot},
+		{"devicePath", c.DevicePath},
+		{"pciDevicesPath", c.PCIDevicesPath},
+	} {
+		if !filepath.IsAbs(p.path) {
+			errs = append(errs, fmt.Errorf("%s: must be an absolute path, got %q", p.name, p.path))
+		}
+	}
+	if c.NFDFeaturesPath != "" && !filepath.IsAbs(c.NFDFeaturesPath) {
+		errs = append(errs, fmt.Errorf("nfdFeaturesPath: must be an absolute path or empty, got %q", c.NFDFeaturesPath))
+	}
+	if _, err := newDeviceFilter(c); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseEnvTemplates(c.AllocateEnv); err != nil {
+		errs = append(errs, fmt.Errorf("allocateEnv: %w", err))
+	}
+	if c.NodeLabels && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to label the node"))
+	}
+	if c.HealthEvents && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to record health events"))
+	}
+	if (c.NodeCondition || c.UnhealthyTaint != "") && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to report device health on the node"))
+	}
+	if c.UnhealthyTaint != "" {
+		if _, err := parseTaint(c.UnhealthyTaint); err != nil {
+			errs = append(errs, fmt.Errorf("unhealthyTaint: %w", err))
+		}
+	}
+	if c.PodResourcesSocket != "" && !filepath.IsAbs(c.PodResourcesSocket) {
+		errs = append(errs, fmt.Errorf("podResourcesSocket: must be an absolute path or empty, got %q", c.PodResourcesSocket))
+	}
+	if c.PodResourcesInterval <= 0 {
+		errs = append(errs, errors.New("podResourcesInterval: must be positive"))
+	}
+	if actions, err := parseFailedDeviceActions(c.FailedDeviceActions); err != nil {
+		errs = append(errs, fmt.Errorf("failedDeviceActions: %w", err))
+	} else if len(actions) > 0 && c.PodResourcesSocket == "" {
+		errs = append(errs, errors.New("podResourcesSocket: must be set to react to failed devices"))
+	} else if slices.Contains(actions, failedDeviceEvent) && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to record failed device events"))
+	}
+	if c.MaxEvictions < 1 {
+		errs = append(errs, errors.New("maxEvictions: must be at least 1"))
+	}
+	if c.EvictionInterval <= 0 {
+		errs = append(errs, errors.New("evictionInterval: must be positive"))
+	}
+	if c.UnhealthyThreshold < 1 {
+		errs = append(errs, errors.New("unhealthyThreshold: must be at least 1"))
+	}
+	if c.NodeResourceTopology && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to publish the node resource topology"))
+	}
+	if c.TopologyManagerPolicy != "" && !slices.Contains(topologyManagerPolicies, c.TopologyManagerPolicy) {
+		errs = append(errs, fmt.Errorf("topologyManagerPolicy: must be one of %s or empty, got %q",
+			strings.Join(topologyManagerPolicies, ", "), c.TopologyManagerPolicy))
+	}
+	if !slices.Contains(topologyManagerScopes, c.TopologyManagerScope) {
+		errs = append(errs, fmt.Errorf("topologyManagerScope: must be one of %s, got %q",
+			strings.Join(topologyManagerScopes, ", "), c.TopologyManagerScope))
+	}
+	if c.ModuleAnnotations && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to annotate the node with device modules"))
+	}
+	if c.DeviceObjects && c.NodeName == "" {
+		errs = append(errs, errors.New("nodeName: must be set to report Habana device objects"))
+	}
+	if !driverNameRe.MatchString(c.DRADriverName) {
+		errs = append(errs, fmt.Errorf("draDriverName: must be a DNS subdomain, got %q", c.DRADriverName))
+	}
+	if c.KubeletDialTimeout <= 0 {
+		errs = append(errs, errors.New("kubeletDialTimeout: must be positive"))
+	}
+	if c.RegistrationBackoff <= 0 || c.RegistrationMaxBackoff < c.RegistrationBackoff {
+		errs = append(errs, errors.New("registrationBackoff: must be positive and not exceed registrationMaxBackoff"))
+	}
+	if c.RegistrationDeadline < 0 {
+		errs = append(errs, errors.New("registrationDeadline: must not be negative"))
+	}
+	if c.RegistrationCheckInterval <= 0 {
+		errs = append(errs, errors.New("registrationCheckInterval: must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdownTimeout: must be positive"))
+	}
+	if c.DevicePollInterval <= 0 {
+		errs = append(errs, errors.New("devicePollInterval: must be positive"))
+	}
+	if c.HealthCheckInterval <= 0 {
+		errs = append(errs, errors.New("healthCheckInterval: must be positive"))
+	}
+	if c.EventWaitTimeout <= 0 || c.EventWaitTimeout > c.HealthCheckInterval {
+		errs = append(errs, errors.New("eventWaitTimeout: must be positive and not exceed healthCheckInterval"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// HostPath returns where the host path p can be read from inside the
+// plugin's container.
+func (c *Config) HostPath(p string) string {
+	return filepath.Join(c.HostRoot, p)
+}
+
+// KubeletSocket returns the path of the kubelet registration socket.
+func (c *Config) KubeletSocket() string {
+	return filepath.Join(c.DevicePluginPath, filepath.Base(pluginapi.KubeletSocket))
+}
+
+// KubeletCheckpoint returns the path of the checkpoint of kubelet's device
+// manager.
+func (c *Config) KubeletCheckpoint() string {
+	return filepath.Join(c.DevicePluginPath, kubeletCheckpointFile)
+}
+
+// ResourceName returns the extended resource name for devType.
+func (c *Config) ResourceName(devType string) string {
+	return c.ResourcePrefix + devType
+}
+
+// PluginSocket returns the path of the plugin socket for devType.
+func (c *Config) PluginSocket(devType string) string {
+	return filepath.Join(c.DevicePluginPath, devType+"_habanalabs.sock")
+}
+
+// RegistrationSocket returns the path of the plugin registration socket
+// for devType, in pluginwatcher registration mode.
+func (c *Config) RegistrationSocket(devType string) string {
+	return filepath.Join(c.PluginsRegistryPath, devType+"_habanalabs-reg.sock")
+}
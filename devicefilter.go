@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deviceSelectors select devices by serial number or module ID.
+type deviceSelectors struct {
+	serials map[string]bool
+	modules map[uint]bool
+}
+
+// parseDeviceSelectors parses a comma-separated list of serial numbers and
+// module IDs. Numbers are module IDs.
+func parseDeviceSelectors(s string) (deviceSelectors, error) {
+	sel := deviceSelectors{serials: make(map[string]bool), modules: make(map[uint]bool)}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if id, err := strconv.ParseUint(f, 10, 0); err == nil {
+			sel.modules[uint(id)] = true
+			continue
+		}
+		if strings.ContainsAny(f, " \t=") {
+			return deviceSelectors{}, fmt.Errorf("invalid device %q, expected a serial number or module ID", f)
+		}
+		sel.serials[f] = true
+	}
+	return sel, nil
+}
+
+func (s deviceSelectors) empty() bool {
+	return len(s.serials) == 0 && len(s.modules) == 0
+}
+
+// matches reports whether the device with serial id and, if known, module
+// ID moduleID is selected.
+func (s deviceSelectors) matches(id string, moduleID uint, hasModule bool) bool {
+	return s.serials[id] || (hasModule && s.modules[moduleID])
+}
+
+// deviceFilter selects the devices the plugin advertises: those of the
+// allow list, or every device when it is empty, except those of the deny
+// list.
+type deviceFilter struct {
+	allow, deny deviceSelectors
+}
+
+func newDeviceFilter(cfg *Config) (*deviceFilter, error) {
+	allow, err := parseDeviceSelectors(cfg.DeviceAllowList)
+	if err != nil {
+		return nil, fmt.Errorf("deviceAllowList: %w", err)
+	}
+	deny, err := parseDeviceSelectors(cfg.DeviceDenyList)
+	if err != nil {
+		return nil, fmt.Errorf("deviceDenyList: %w", err)
+	}
+	return &deviceFilter{allow: allow, deny: deny}, nil
+}
+
+// allows reports whether the device with serial id is advertised, given
+// the module IDs of the devices.
+func (f *deviceFilter) allows(id string, moduleIDs map[string]uint) bool {
+	moduleID, ok := moduleIDs[id]
+	if f.deny.matches(id, moduleID, ok) {
+		return false
+	}
+	return f.allow.empty() || f.allow.matches(id, moduleID, ok)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// deviceEventSettle delays the device check after a devfs or sysfs
+	// event, as a loading driver creates many nodes in a burst.
+	deviceEventSettle = time.Second
+	// waitingLogInterval is how often waiting for devices is reported at
+	// info level. Every check is logged at debug level.
+	waitingLogInterval = 5 * time.Minute
+)
+
+// deviceWaiter tracks the plugin while no devices are present. It watches
+// the device directories for changes and schedules periodic checks, so the
+// plugin neither spins nor misses devices showing up.
+type deviceWaiter struct {
+	log     *slog.Logger
+	watcher *fsnotify.Watcher
+
+	waiting bool
+	since   time.Time
+	lastLog time.Time
+	checks  int
+	// paths are the device directories devices appear in, and watched
+	// the directories watched for them: the paths or, while missing, their
+	// closest existing parents.
+	paths   []string
+	watched []string
+}
+
+func newDeviceWaiter(log *slog.Logger, watcher *fsnotify.Watcher) *deviceWaiter {
+	return &deviceWaiter{log: log, watcher: watcher}
+}
+
+// Waiting reports whether the plugin is waiting for devices.
+func (w *deviceWaiter) Waiting() bool {
+	return w.waiting
+}
+
+// Wait records that no devices were found and returns a channel firing
+// when the next check is due.
+func (w *deviceWaiter) Wait(cfg *Config) <-chan time.Time {
+	now := time.Now()
+	w.checks++
+
+	// Directories created since the last check are watched from now on.
+	w.watch(cfg)
+
+	if !w.waiting {
+		w.waiting, w.since, w.lastLog = true, now, now
+		w.log.Warn("No Habana devices found, waiting for devices to appear",
+			"poll_interval", cfg.DevicePollInterval, "watched", w.watched)
+	} else if now.Sub(w.lastLog) >= waitingLogInterval {
+		w.lastLog = now
+		w.log.Info("Still waiting for Habana devices", "waiting_for", now.Sub(w.since).Round(time.Second), "checks", w.checks)
+	} else {
+		w.log.Debug("No Habana devices found", "checks", w.checks)
+	}
+
+	return time.After(cfg.DevicePollInterval)
+}
+
+// Found records that devices are present and stops watching for them.
+func (w *deviceWaiter) Found() {
+	if !w.waiting {
+		return
+	}
+	w.log.Info("Habana devices appeared", "waited", time.Since(w.since).Round(time.Second), "checks", w.checks)
+	for _, p := range w.watched {
+		_ = w.watcher.Remove(p)
+	}
+	*w = deviceWaiter{log: w.log, watcher: w.watcher}
+}
+
+// IsDeviceEvent reports whether event happened in a device directory, or
+// created one of its missing parents. Other events in the parents watched
+// in place of a missing directory, e.g. /dev, are ignored.
+func (w *deviceWaiter) IsDeviceEvent(event fsnotify.Event) bool {
+	for _, p := range w.paths {
+		if isWithin(event.Name, p) || isWithin(p, event.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin reports whether path is dir or lies under it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// watch adds the devfs and sysfs directories devices appear in to the
+// watcher. A directory that does not exist yet is replaced by its closest
+// existing parent, so that its creation is noticed too.
+func (w *deviceWaiter) watch(cfg *Config) {
+	w.paths = []string{cfg.HostPath(cfg.DevicePath), cfg.HostPath(cfg.PCIDevicesPath)}
+	for _, p := range w.paths {
+		for {
+			if _, err := os.Stat(p); err == nil || p == filepath.Dir(p) {
+				break
+			}
+			p = filepath.Dir(p)
+		}
+		if slices.Contains(w.watched, p) {
+			continue
+		}
+		if err := w.watcher.Add(p); err != nil {
+			w.log.Warn("Failed watching for devices, relying on polling", "path", p, "error", err)
+			continue
+		}
+		w.watched = append(w.watched, p)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDeviceWaiterEvents(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// /dev/accel is missing, so /dev is watched in its place.
+	root := t.TempDir()
+	for _, dir := range []string{"dev", "sys/bus/pci/devices"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := defaultConfig()
+	cfg.HostRoot = root
+	w := newDeviceWaiter(logs.Logger(), watcher)
+	w.Wait(cfg)
+	if want := filepath.Join(root, "dev"); len(w.watched) != 2 || w.watched[0] != want {
+		t.Fatalf("watched %v, want %s first", w.watched, want)
+	}
+
+	for name, want := range map[string]bool{
+		"dev/accel":                        true,
+		"dev/accel/accel0":                 true,
+		"dev/tty1":                         false,
+		"dev/accelerator":                  false,
+		"sys/bus/pci/devices/0000:33:00.0": true,
+		"sys/bus/pci/drivers":              false,
+	} {
+		event := fsnotify.Event{Name: filepath.Join(root, name), Op: fsnotify.Create}
+		if got := w.IsDeviceEvent(event); got != want {
+			t.Errorf("IsDeviceEvent(%s) = %t, want %t", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sync/errgroup"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// cdiVersion is the version of the CDI specs written for prepared claims.
+const cdiVersion = "0.6.0"
+
+// draDevice is a device published in the node's ResourceSlice.
+type draDevice struct {
+	dev      *pluginapi.Device
+	model    string
+	moduleID uint
+}
+
+// draDriver is a Dynamic Resource Allocation kubelet plugin. It publishes
+// the devices found by the DeviceManager as a ResourceSlice, and prepares
+// claims by writing CDI specs with the device nodes and environment
+// Allocate would return.
+type draDriver struct {
+	log *slog.Logger
+	cfg *Config
+	// fatal ends the driver on errors that retrying won't fix.
+	fatal context.CancelCauseFunc
+
+	model  string
+	devs   []*pluginapi.Device
+	helper *kubeletplugin.Helper
+
+	mu sync.Mutex
+	// devices are indexed by their name in the ResourceSlice.
+	devices map[string]*draDevice
+}
+
+func newDRADriver(log *slog.Logger, cfg *Config, model string, devs []*pluginapi.Device, fatal context.CancelCauseFunc) *draDriver {
+	return &draDriver{
+		log:     log,
+		cfg:     cfg,
+		fatal:   fatal,
+		model:   model,
+		devs:    devs,
+		devices: make(map[string]*draDevice, len(devs)),
+	}
+}
+
+// invalidNameChars matches what a device name, a DNS label, can't hold.
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// draDeviceName returns the name of the device with serial id in the
+// ResourceSlice.
+func draDeviceName(id string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(id), "-"), "-")
+}
+
+// discover looks up the attributes published for every device.
+func (d *draDriver) discover(ctx context.Context) error {
+	for _, dev := range d.devs {
+		var handle *Device
+		err := traceHLML(ctx, "DeviceHandleBySerial", func() (err error) {
+			handle, err = hlml.DeviceHandleBySerial(dev.ID)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed getting device %s: %w", dev.ID, err)
+		}
+		var moduleID uint
+		err = traceHLML(ctx, "ModuleID", func() (err error) {
+			moduleID, err = handle.ModuleID()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed getting module ID of device %s: %w", dev.ID, err)
+		}
+		d.devices[draDeviceName(dev.ID)] = &draDevice{dev: dev, model: d.model, moduleID: moduleID}
+	}
+	return nil
+}
+
+// resources returns the ResourceSlice content of the node's pool.
+func (d *draDriver) resources() resourceslice.DriverResources {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	names := make([]string, 0, len(d.devices))
+	for name := range d.devices {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	devices := make([]resourceapi.Device, 0, len(names))
+	for _, name := range names {
+		dev := d.devices[name]
+		attrs := map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			"model":    {StringValue: &dev.model},
+			"serial":   {StringValue: &dev.dev.ID},
+			"moduleID": {IntValue: ptr(int64(dev.moduleID))},
+			"healthy":  {BoolValue: ptr(dev.dev.Health == pluginapi.Healthy)},
+		}
+		if t := dev.dev.Topology; t != nil && len(t.Nodes) > 0 {
+			attrs["numaNode"] = resourceapi.DeviceAttribute{IntValue: ptr(t.Nodes[0].ID)}
+		}
+		devices = append(devices, resourceapi.Device{Name: name, Attributes: attrs})
+	}
+
+	return resourceslice.DriverResources{
+		Pools: map[string]resourceslice.Pool{
+			d.cfg.NodeName: {Slices: []resourceslice.Slice{{Devices: devices}}},
+		},
+	}
+}
+
+// publish publishes the ResourceSlice of the node.
+func (d *draDriver) publish(ctx context.Context) error {
+	return d.helper.PublishResources(ctx, d.resources())
+}
+
+// unhealthy marks the device with serial id unhealthy and publishes the
+// change.
+func (d *draDriver) unhealthy(ctx context.Context, id string) {
+	d.mu.Lock()
+	dev, ok := d.devices[draDeviceName(id)]
+	changed := ok && dev.dev.Health != pluginapi.Unhealthy
+	if changed {
+		dev.dev.Health = pluginapi.Unhealthy
+	}
+	d.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	d.log.Warn("Device is unhealthy", "id", id)
+	if err := d.publish(ctx); err != nil {
+		d.log.Error("Failed publishing device health", "id", id, "error", err)
+	}
+}
+
+// PrepareResourceClaims writes a CDI spec for every claim, with a single
+// CDI device for the devices of the claim.
+func (d *draDriver) PrepareResourceClaims(ctx context.Context, claims []*resourceapi.ResourceClaim) (map[types.UID]kubeletplugin.PrepareResult, error) {
+	result := make(map[types.UID]kubeletplugin.PrepareResult, len(claims))
+	for _, claim := range claims {
+		result[claim.UID] = d.prepare(ctx, claim)
+	}
+	return result, nil
+}
+
+// prepare prepares the devices of claim. A claim may only request devices
+// of the driver once: the environment Allocate returns describes all the
+// devices of a container, so the CDI devices of separate requests would
+// override each other's in a container consuming the whole claim.
+func (d *draDriver) prepare(ctx context.Context, claim *resourceapi.ResourceClaim) kubeletplugin.PrepareResult {
+	log := d.log.With("claim", claim.Namespace+"/"+claim.Name, "uid", claim.UID)
+	if claim.Status.Allocation == nil {
+		return kubeletplugin.PrepareResult{Err: errors.New("claim is not allocated")}
+	}
+
+	var request string
+	var ids []string
+	var devices []kubeletplugin.Device
+	for _, r := range claim.Status.Allocation.Devices.Results {
+		if r.Driver != d.cfg.DRADriverName {
+			continue
+		}
+		if request != "" && r.Request != request {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf(
+				"claim requests %s devices in both %s and %s, only one request per claim is supported: use separate claims", d.cfg.DRADriverName, request, r.Request)}
+		}
+		request = r.Request
+
+		d.mu.Lock()
+		dev, ok := d.devices[r.Device]
+		healthy := ok && dev.dev.Health == pluginapi.Healthy
+		d.mu.Unlock()
+		if !ok {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf("device %s of request %s is unknown", r.Device, r.Request)}
+		}
+		if !healthy {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf("device %s of request %s is unhealthy", r.Device, r.Request)}
+		}
+		ids = append(ids, dev.dev.ID)
+		devices = append(devices, kubeletplugin.Device{
+			Requests:     []string{r.Request},
+			PoolName:     r.Pool,
+			DeviceName:   r.Device,
+			CDIDeviceIDs: []string{d.cdiDeviceID(claim.UID, r.Request)},
+		})
+	}
+
+	spec := cdiSpec{Version: cdiVersion, Kind: d.cdiKind()}
+	if request != "" {
+		resp, err := allocateContainer(ctx, log, d.cfg, d.cfg.DRADriverName, d.devs, ids)
+		if err != nil {
+			return kubeletplugin.PrepareResult{Err: err}
+		}
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name:           cdiDeviceName(claim.UID, request),
+			ContainerEdits: cdiEditsFor(resp),
+		})
+	}
+	if err := writeCDISpec(d.cdiSpecPath(claim.UID), &spec); err != nil {
+		return kubeletplugin.PrepareResult{Err: err}
+	}
+
+	log.Info("Prepared resource claim", "devices", len(devices))
+	return kubeletplugin.PrepareResult{Devices: devices}
+}
+
+// UnprepareResourceClaims removes the CDI specs of the claims.
+func (d *draDriver) UnprepareResourceClaims(_ context.Context, claims []kubeletplugin.NamespacedObject) (map[types.UID]error, error) {
+	result := make(map[types.UID]error, len(claims))
+	for _, claim := range claims {
+		err := os.Remove(d.cdiSpecPath(claim.UID))
+		if err != nil && !os.IsNotExist(err) {
+			result[claim.UID] = err
+			continue
+		}
+		result[claim.UID] = nil
+		d.log.Info("Unprepared resource claim", "claim", claim.String())
+	}
+	return result, nil
+}
+
+// HandleError logs errors encountered in the background, e.g. while
+// publishing the ResourceSlice, and stops the driver on fatal ones.
+func (d *draDriver) HandleError(_ context.Context, err error, msg string) {
+	if errors.Is(err, kubeletplugin.ErrRecoverable) {
+		d.log.Warn(msg, "error", err)
+		return
+	}
+	d.log.Error(msg, "error", err)
+	d.fatal(fmt.Errorf("%s: %w", msg, err))
+}
+
+// cdiKind returns the CDI kind of the devices of prepared claims.
+func (d *draDriver) cdiKind() string {
+	return d.cfg.DRADriverName + "/claim"
+}
+
+func (d *draDriver) cdiDeviceID(uid types.UID, request string) string {
+	return d.cdiKind() + "=" + cdiDeviceName(uid, request)
+}
+
+func (d *draDriver) cdiSpecPath(uid types.UID) string {
+	return filepath.Join(d.cfg.CDIRoot, d.cfg.DRADriverName+"-claim_"+string(uid)+".json")
+}
+
+// invalidCDINameChars matches what a CDI device name can't hold, e.g. the
+// slash of subrequest names.
+var invalidCDINameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+func cdiDeviceName(uid types.UID, request string) string {
+	return string(uid) + "-" + invalidCDINameChars.ReplaceAllString(request, "-")
+}
+
+// cdiSpec is the subset of the Container Device Interface specification
+// used for prepared claims.
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string   `json:"name"`
+	ContainerEdits cdiEdits `json:"containerEdits"`
+}
+
+type cdiEdits struct {
+	Env         []string        `json:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// cdiEditsFor converts the response of allocateContainer to CDI container
+// edits.
+func cdiEditsFor(resp *pluginapi.ContainerAllocateResponse) cdiEdits {
+	var edits cdiEdits
+	for k, v := range resp.Envs {
+		edits.Env = append(edits.Env, k+"="+v)
+	}
+	slices.Sort(edits.Env)
+	for _, ds := range resp.Devices {
+		edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{
+			Path:        ds.ContainerPath,
+			HostPath:    ds.HostPath,
+			Permissions: ds.Permissions,
+		})
+	}
+	return edits
+}
+
+// writeCDISpec writes spec to path atomically, so that the container
+// runtime never reads a partial spec.
+func writeCDISpec(path string, spec *cdiSpec) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed writing CDI spec: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a hidden temporary file next to path and
+// renames it over path, so that readers see either the old or the new
+// content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// klogContext returns ctx carrying log as the klog logger, which the
+// Kubernetes libraries log through.
+func klogContext(ctx context.Context, log *slog.Logger) context.Context {
+	return klog.NewContext(ctx, logr.FromSlogHandler(log.Handler()))
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// startDRADriver starts serving kubelet the devices devs of model. The
+// caller publishes them and stops the driver's helper.
+func startDRADriver(ctx context.Context, logs *logging, cfg *Config, client kubernetes.Interface, model string, devs []*pluginapi.Device, fatal context.CancelCauseFunc) (*draDriver, error) {
+	pluginDir := filepath.Join(cfg.KubeletPluginsPath, cfg.DRADriverName)
+	for _, dir := range []string{cfg.CDIRoot, pluginDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed creating directory: %w", err)
+		}
+	}
+
+	driver := newDRADriver(logs.For(subsystemDiscovery), cfg, model, devs, fatal)
+	if err := driver.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	// Interceptors are chained in order, like serverInterceptors: the
+	// logging one sees the errors recovered panics are turned into.
+	grpcLog := logs.For(subsystemGRPC)
+	var err error
+	driver.helper, err = kubeletplugin.Start(klogContext(ctx, grpcLog), driver,
+		kubeletplugin.DriverName(cfg.DRADriverName),
+		kubeletplugin.NodeName(cfg.NodeName),
+		kubeletplugin.KubeClient(client),
+		kubeletplugin.RegistrarDirectoryPath(cfg.PluginsRegistryPath),
+		kubeletplugin.PluginDataDirectoryPath(pluginDir),
+		kubeletplugin.GRPCInterceptor(unaryLoggingInterceptor(grpcLog)),
+		kubeletplugin.GRPCInterceptor(unaryRecoveryInterceptor(grpcLog)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed starting DRA kubelet plugin: %w", err)
+	}
+	return driver, nil
+}
+
+// runDRA runs the plugin as a Dynamic Resource Allocation kubelet plugin
+// until it is signaled to stop or fails.
+func runDRA(log *slog.Logger, logs *logging, cfg *Config) error {
+	if cfg.NodeName == "" {
+		return errors.New("nodeName must be set to run the DRA driver")
+	}
+	log.Info("Started Habana DRA driver", "version", build, "driver", cfg.DRADriverName, "node", cfg.NodeName)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// A signal stops the driver by canceling ctx without a cause, a fatal
+	// error by canceling it with one.
+	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Info("Received OS signal. Shutting down", "signal", s)
+			cancel(nil)
+		case <-ctx.Done():
+		}
+	}()
+
+	ready := newReadiness()
+	if cfg.AdminAddr != "" {
+		adminServer := newAdminServer(log, cfg.AdminAddr, logs, ready, nil)
+		startAdminServer(log, adminServer)
+		defer adminServer.Close()
+	}
+
+	client, err := (&kubeClients{kubeconfig: cfg.Kubeconfig}).clientset()
+	if err != nil {
+		return err
+	}
+
+	hlmlLog.Info("Initializing HLML...")
+	if err := hlml.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize HLML: %w", err)
+	}
+	defer func() {
+		hlmlLog.Info("Shutting down hlml")
+		if err := hlml.Shutdown(); err != nil {
+			hlmlLog.Error(err.Error())
+		}
+	}()
+
+	model, err := hlml.GetDeviceTypeName()
+	if err != nil {
+		return fmt.Errorf("failed detecting Habana's devices on the system: %w", err)
+	}
+	devs, err := NewDeviceManager(logs.For(subsystemDiscovery), strings.ToUpper(model)).Devices(ctx)
+	if err != nil {
+		return fmt.Errorf("failed discovering devices: %w", err)
+	}
+	if len(devs) == 0 {
+		return errors.New("no Habana devices found")
+	}
+
+	ready.Set(stateRegistering, "starting DRA driver")
+	driver, err := startDRADriver(ctx, logs, cfg, client, model, devs, cancel)
+	if err != nil {
+		return err
+	}
+	defer driver.helper.Stop()
+
+	// Publishing waits for the ResourceSlice informer to sync, until the
+	// API server is reachable or the driver is stopped.
+	if err := driver.publish(ctx); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed publishing devices: %w", err)
+	}
+	if ctx.Err() == nil {
+		ready.Set(stateRegistered, "")
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	xids := make(chan deviceFailure)
+	g.Go(func() error {
+		watchXIDs(gctx, logs.For(subsystemHealth), devs, xids, func() *Config { return cfg })
+		return nil
+	})
+	g.Go(func() error {
+		for {
+			select {
+			case <-gctx.Done():
+				return nil
+			case f := <-xids:
+				driver.unhealthy(gctx, f.dev.ID)
+			}
+		}
+	})
+
+	<-ctx.Done()
+	_ = g.Wait()
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		ready.Set(stateStopping, "DRA driver failed")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+)
+
+// waitSlice waits for the single ResourceSlice of client to satisfy ok.
+func waitSlice(t *testing.T, client *fake.Clientset, ok func(*resourceapi.ResourceSlice) bool) *resourceapi.ResourceSlice {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		slices, err := client.ResourceV1().ResourceSlices().List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slices.Items) == 1 && ok(&slices.Items[0]) {
+			return &slices.Items[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no matching ResourceSlice among %d", len(slices.Items))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// sliceHealth returns the healthy attribute of the device name of slice.
+func sliceHealth(slice *resourceapi.ResourceSlice, name string) *bool {
+	for _, d := range slice.Spec.Devices {
+		if d.Name == name {
+			return d.Attributes["healthy"].BoolValue
+		}
+	}
+	return nil
+}
+
+func TestDRADriver(t *testing.T) {
+	hlml = getHlml()
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.NodeName = "node-1"
+	cfg.KubeletPluginsPath = filepath.Join(dir, "plugins")
+	cfg.PluginsRegistryPath = filepath.Join(dir, "plugins_registry")
+	cfg.CDIRoot = filepath.Join(dir, "cdi")
+	cfg.HostRoot = dir
+	cfg.PCIDevicesPath = dir
+	if err := os.MkdirAll(cfg.PluginsRegistryPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	devs, err := NewDeviceManager(logs.Logger(), "GAUDI").Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ResourceSlice is owned by the Node.
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: cfg.NodeName, UID: "node-uid"}})
+	driver, err := startDRADriver(ctx, logs, cfg, client, "gaudi", devs, cancel)
+	if err != nil {
+		t.Fatalf("startDRADriver() = %v", err)
+	}
+	defer driver.helper.Stop()
+
+	if err := driver.publish(ctx); err != nil {
+		t.Fatalf("publish() = %v", err)
+	}
+	first := draDeviceName(devs[0].ID)
+	slice := waitSlice(t, client, func(s *resourceapi.ResourceSlice) bool { return len(s.Spec.Devices) == len(devs) })
+	if slice.Spec.Driver != cfg.DRADriverName || slice.Spec.Pool.Name != cfg.NodeName ||
+		slice.Spec.NodeName == nil || *slice.Spec.NodeName != cfg.NodeName {
+		t.Errorf("ResourceSlice driver %q, pool %q, node %v", slice.Spec.Driver, slice.Spec.Pool.Name, slice.Spec.NodeName)
+	}
+	if refs := slice.OwnerReferences; len(refs) != 1 || refs[0].UID != "node-uid" {
+		t.Errorf("ResourceSlice owners = %v, want the node", refs)
+	}
+	i := slices.IndexFunc(slice.Spec.Devices, func(d resourceapi.Device) bool { return d.Name == first })
+	if i < 0 {
+		t.Fatalf("device %s not published", first)
+	}
+	attrs := slice.Spec.Devices[i].Attributes
+	if v := attrs["serial"].StringValue; v == nil || *v != devs[0].ID {
+		t.Errorf("serial = %v, want %s", v, devs[0].ID)
+	}
+	if v := attrs["model"].StringValue; v == nil || *v != "gaudi" {
+		t.Errorf("model = %v, want gaudi", v)
+	}
+	if v := attrs["moduleID"].IntValue; v == nil || *v != 0 {
+		t.Errorf("moduleID = %v, want 0", v)
+	}
+	if v := sliceHealth(slice, first); v == nil || !*v {
+		t.Errorf("healthy = %v, want true", v)
+	}
+
+	driver.unhealthy(ctx, devs[0].ID)
+	waitSlice(t, client, func(s *resourceapi.ResourceSlice) bool {
+		v := sliceHealth(s, first)
+		return v != nil && !*v
+	})
+
+	claim := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "train", UID: "uid-1"},
+		Status: resourceapi.ResourceClaimStatus{Allocation: &resourceapi.AllocationResult{
+			Devices: resourceapi.DeviceAllocationResult{Results: []resourceapi.DeviceRequestAllocationResult{
+				{Request: "gaudi", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: draDeviceName(devs[1].ID)},
+				{Request: "gaudi", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: draDeviceName(devs[2].ID)},
+				{Request: "other", Driver: "other.example.com", Pool: cfg.NodeName, Device: "x"},
+			}},
+		}},
+	}
+	unknown := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unknown", UID: "uid-2"},
+		Status: resourceapi.ResourceClaimStatus{Allocation: &resourceapi.AllocationResult{
+			Devices: resourceapi.DeviceAllocationResult{Results: []resourceapi.DeviceRequestAllocationResult{
+				{Request: "gaudi", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: "missing"},
+			}},
+		}},
+	}
+	// devs[0] is unhealthy.
+	unhealthy := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unhealthy", UID: "uid-3"},
+		Status: resourceapi.ResourceClaimStatus{Allocation: &resourceapi.AllocationResult{
+			Devices: resourceapi.DeviceAllocationResult{Results: []resourceapi.DeviceRequestAllocationResult{
+				{Request: "gaudi", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: first},
+			}},
+		}},
+	}
+	twoRequests := &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "two", UID: "uid-4"},
+		Status: resourceapi.ResourceClaimStatus{Allocation: &resourceapi.AllocationResult{
+			Devices: resourceapi.DeviceAllocationResult{Results: []resourceapi.DeviceRequestAllocationResult{
+				{Request: "train", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: draDeviceName(devs[1].ID)},
+				{Request: "eval", Driver: cfg.DRADriverName, Pool: cfg.NodeName, Device: draDeviceName(devs[2].ID)},
+			}},
+		}},
+	}
+	results, err := driver.PrepareResourceClaims(ctx, []*resourceapi.ResourceClaim{claim, unknown, unhealthy, twoRequests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for uid, want := range map[types.UID]string{
+		"uid-2": "device missing of request gaudi is unknown",
+		"uid-3": "device " + first + " of request gaudi is unhealthy",
+		"uid-4": "claim requests habana.ai devices in both train and eval",
+	} {
+		if err := results[uid].Err; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("preparing claim %s: %v, want %q", uid, err, want)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.CDIRoot, "habana.ai-claim_"+string(uid)+".json")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("CDI spec of the failed claim %s written: %v", uid, err)
+		}
+	}
+	prepared := results["uid-1"]
+	if prepared.Err != nil {
+		t.Fatalf("preparing claim: %v", prepared.Err)
+	}
+	const cdiID = "habana.ai/claim=uid-1-gaudi"
+	if len(prepared.Devices) != 2 {
+		t.Fatalf("prepared %d devices, want 2", len(prepared.Devices))
+	}
+	for _, d := range prepared.Devices {
+		if !slices.Equal(d.CDIDeviceIDs, []string{cdiID}) || !slices.Equal(d.Requests, []string{"gaudi"}) {
+			t.Errorf("prepared device %s: CDI devices %v, requests %v", d.DeviceName, d.CDIDeviceIDs, d.Requests)
+		}
+	}
+
+	path := filepath.Join(cfg.CDIRoot, "habana.ai-claim_uid-1.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec cdiSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Kind != "habana.ai/claim" || len(spec.Devices) != 1 || spec.Devices[0].Name != "uid-1-gaudi" {
+		t.Fatalf("CDI spec = %+v", spec)
+	}
+	edits := spec.Devices[0].ContainerEdits
+	if want := "HL_VISIBLE_DEVICES_UUID=" + devs[1].ID + "," + devs[2].ID; !slices.Contains(edits.Env, want) {
+		t.Errorf("CDI env = %v, want %s", edits.Env, want)
+	}
+	if len(edits.DeviceNodes) != 4 {
+		t.Errorf("CDI device nodes = %v, want 4", edits.DeviceNodes)
+	}
+
+	unprepared, err := driver.UnprepareResourceClaims(ctx, []kubeletplugin.NamespacedObject{
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "train"}, UID: "uid-1"},
+	})
+	if err != nil || unprepared["uid-1"] != nil {
+		t.Fatalf("UnprepareResourceClaims() = %v, %v", unprepared, err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CDI spec still present after unprepare: %v", err)
+	}
+}
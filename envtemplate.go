@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// allocatedEnv are the environment variables Allocate sets itself, which
+// templates can't override.
+var allocatedEnv = []string{"HABANA_VISIBLE_DEVICES", "HL_VISIBLE_DEVICES", "HL_VISIBLE_DEVICES_UUID", "HABANA_VISIBLE_MODULES"}
+
+// allocation describes the devices allocated to a container, for env
+// templates. The lists are comma-separated.
+type allocation struct {
+	Resource string
+	Count    int
+	Serials  string
+	Modules  string
+	Minors   string
+}
+
+// envTemplate is an environment variable added to the containers devices
+// are allocated to, its value rendered from their allocation.
+type envTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+// parseEnvTemplates parses a comma-separated list of NAME=template, the
+// templates being text/template over an allocation, e.g.
+// HABANA_LOGS=/var/log/habana_logs/{{.Serials}}.
+func parseEnvTemplates(s string) ([]envTemplate, error) {
+	var templates []envTemplate
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		name, text, ok := strings.Cut(f, "=")
+		if msgs := validation.IsEnvVarName(name); !ok || len(msgs) > 0 {
+			return nil, fmt.Errorf("%q must be of the form NAME=template", f)
+		}
+		if slices.Contains(allocatedEnv, name) {
+			return nil, fmt.Errorf("%s is set by the plugin", name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		// Unknown fields only fail when executed.
+		if err := tmpl.Execute(io.Discard, allocation{}); err != nil {
+			return nil, err
+		}
+		templates = append(templates, envTemplate{name: name, tmpl: tmpl})
+	}
+	return templates, nil
+}
+
+// renderEnvTemplates adds the variables of templates rendered from a to
+// env.
+func renderEnvTemplates(templates []envTemplate, a allocation, env map[string]string) error {
+	for _, t := range templates {
+		var b strings.Builder
+		if err := t.tmpl.Execute(&b, a); err != nil {
+			return fmt.Errorf("failed rendering %s: %w", t.name, err)
+		}
+		env[t.name] = b.String()
+	}
+	return nil
+}
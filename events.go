@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Reasons of the events recorded on device health transitions.
+const (
+	eventDeviceUnhealthy = "HabanaDeviceUnhealthy"
+	eventDeviceHealthy   = "HabanaDeviceHealthy"
+)
+
+// eventComponent is the source component of the recorded events.
+const eventComponent = "habanalabs-device-plugin"
+
+// podLookup returns references to the pods using the device with serial
+// id, when known.
+type podLookup func(id string) []*corev1.ObjectReference
+
+// healthEvents records Kubernetes Events on the Node, and on the pods
+// using the device when pods is set, whenever a device changes health.
+// Only transitions are recorded: devices keep their health when the plugin
+// restarts, and one recovers when it is discovered again healthy after
+// disappearing, e.g. once its driver is reloaded. The recorder's correlator
+// aggregates repeated events and rate limits them per object.
+type healthEvents struct {
+	log      *slog.Logger
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+	pods     podLookup
+
+	mu sync.Mutex
+	// health is the last known health of every device by serial, including
+	// those no longer discovered.
+	health map[string]string
+}
+
+// newHealthEvents returns healthEvents that already reported the devices
+// of unhealthy, e.g. before the plugin restarted.
+func newHealthEvents(log *slog.Logger, recorder record.EventRecorder, nodeName string, pods podLookup, unhealthy []string) *healthEvents {
+	e := &healthEvents{
+		log:      log,
+		recorder: recorder,
+		// Like kubelet, reference the Node by name, which is also used as
+		// its UID.
+		node:   &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: types.UID(nodeName)},
+		pods:   pods,
+		health: make(map[string]string),
+	}
+	for _, id := range unhealthy {
+		e.health[id] = pluginapi.Unhealthy
+	}
+	return e
+}
+
+// newEventBroadcaster returns a broadcaster recording events through
+// client, and a recorder of events from the plugin on nodeName. The
+// broadcaster must be shut down to flush the pending events.
+func newEventBroadcaster(client kubernetes.Interface, nodeName string) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		// Allow a burst of events per object, e.g. when several devices
+		// fail together, then one every minute.
+		BurstSize: 16,
+		QPS:       1.0 / 60,
+	}))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName})
+	return broadcaster, recorder
+}
+
+// DevicesChanged records an event for every device whose health differs
+// from the one last seen. Devices seen for the first time are only
+// reported when unhealthy.
+func (e *healthEvents) DevicesChanged(_ nodeFeatures, devs []*pluginapi.Device) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, d := range devs {
+		prev, known := e.health[d.ID]
+		e.health[d.ID] = d.Health
+		if prev == d.Health || !known && d.Health == pluginapi.Healthy {
+			continue
+		}
+		e.record(d)
+	}
+}
+
+// record records the health of d on the Node and the pods using d.
+func (e *healthEvents) record(d *pluginapi.Device) {
+	eventType, reason, message := corev1.EventTypeNormal, eventDeviceHealthy, "Habana device %s is healthy"
+	if d.Health != pluginapi.Healthy {
+		eventType, reason, message = corev1.EventTypeWarning, eventDeviceUnhealthy, "Habana device %s is unhealthy"
+	}
+
+	e.log.Debug("Recording device health event", "id", d.ID, "reason", reason)
+	e.recorder.Eventf(e.node, eventType, reason, message, d.ID)
+	if e.pods == nil {
+		return
+	}
+	for _, pod := range e.pods(d.ID) {
+		e.recorder.Eventf(pod, eventType, reason, message, d.ID)
+	}
+}
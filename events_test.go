@@ -0,0 +1,96 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// drainEvents returns the events recorded so far.
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestHealthEvents(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "train"}
+	pods := func(id string) []*corev1.ObjectReference {
+		if id == "B" {
+			return []*corev1.ObjectReference{pod}
+		}
+		return nil
+	}
+	dev := func(id, health string) *pluginapi.Device { return &pluginapi.Device{ID: id, Health: health} }
+
+	// The first run knows C was unhealthy before it restarted.
+	recorder := record.NewFakeRecorder(16)
+	recorder.IncludeObject = true
+	e := newHealthEvents(logs.Logger(), recorder, "node-1", pods, []string{"C"})
+	steps := []struct {
+		devs []*pluginapi.Device
+		want []string
+	}{
+		// C is not reported again, and healthy devices seen first aren't.
+		{[]*pluginapi.Device{dev("A", pluginapi.Healthy), dev("B", pluginapi.Healthy), dev("C", pluginapi.Unhealthy)}, nil},
+		// B fails, on the node and its pod.
+		{
+			[]*pluginapi.Device{dev("A", pluginapi.Healthy), dev("B", pluginapi.Unhealthy), dev("C", pluginapi.Unhealthy)},
+			[]string{
+				"Warning HabanaDeviceUnhealthy Habana device B is unhealthy involvedObject{kind=Node,apiVersion=}",
+				"Warning HabanaDeviceUnhealthy Habana device B is unhealthy involvedObject{kind=Pod,apiVersion=}",
+			},
+		},
+		// Reporting the same health again records nothing.
+		{[]*pluginapi.Device{dev("A", pluginapi.Healthy), dev("B", pluginapi.Unhealthy), dev("C", pluginapi.Unhealthy)}, nil},
+		// The devices disappear, e.g. while the driver reloads.
+		{nil, nil},
+		// B is discovered again healthy, a real recovery.
+		{
+			[]*pluginapi.Device{dev("A", pluginapi.Healthy), dev("B", pluginapi.Healthy), dev("C", pluginapi.Unhealthy)},
+			[]string{
+				"Normal HabanaDeviceHealthy Habana device B is healthy involvedObject{kind=Node,apiVersion=}",
+				"Normal HabanaDeviceHealthy Habana device B is healthy involvedObject{kind=Pod,apiVersion=}",
+			},
+		},
+	}
+	for i, step := range steps {
+		e.DevicesChanged(nodeFeatures{}, step.devs)
+		if got := drainEvents(recorder); !slices.Equal(got, step.want) {
+			t.Errorf("step %d: events %q, want %q", i, got, step.want)
+		}
+	}
+}
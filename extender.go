@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+// Scores of the placements the free modules of a node allow, out of
+// extenderv1.MaxExtenderPriority.
+const (
+	// placementAligned fits the devices in an aligned power-of-two block of
+	// module IDs, 0-1, 2-3, 0-3, 4-7..., the groups of cards Habana's
+	// collective communication favors.
+	placementAligned = extenderv1.MaxExtenderPriority
+	// placementContiguous fits them in a run of consecutive module IDs.
+	placementContiguous = extenderv1.MaxExtenderPriority / 2
+	// placementScattered only has enough free modules.
+	placementScattered = 1
+)
+
+// placement scores how well n devices fit in the free modules of a node
+// whose devices have modules, or returns 0 when they don't fit.
+func placement(modules, free []int, n int) int64 {
+	if n <= 0 || len(modules) == 0 || len(free) < n {
+		return 0
+	}
+
+	block := 1
+	for block < n {
+		block *= 2
+	}
+	for start := 0; start <= slices.Max(modules); start += block {
+		var present, available int
+		for id := start; id < start+block; id++ {
+			if slices.Contains(modules, id) {
+				present++
+			}
+			if slices.Contains(free, id) {
+				available++
+			}
+		}
+		if present == block && available >= n {
+			return placementAligned
+		}
+	}
+
+	run := 0
+	for id := slices.Min(free); id <= slices.Max(free); id++ {
+		if !slices.Contains(free, id) {
+			run = 0
+			continue
+		}
+		if run++; run >= n {
+			return placementContiguous
+		}
+	}
+	return placementScattered
+}
+
+// containerDevices returns the number of devices of resources under
+// prefix the container requests, from its requests or limits.
+func containerDevices(c *corev1.Container, prefix string) int {
+	n := 0
+	for _, list := range []corev1.ResourceList{c.Resources.Requests, c.Resources.Limits} {
+		for name, q := range list {
+			if strings.HasPrefix(string(name), prefix) {
+				n = max(n, int(q.Value()))
+			}
+		}
+	}
+	return n
+}
+
+// podDevices returns the number of devices of resources under prefix the
+// pod requests: those of its containers, or of its largest init container
+// if more.
+func podDevices(pod *corev1.Pod, prefix string) int {
+	n := 0
+	for i := range pod.Spec.Containers {
+		n += containerDevices(&pod.Spec.Containers[i], prefix)
+	}
+	for i := range pod.Spec.InitContainers {
+		n = max(n, containerDevices(&pod.Spec.InitContainers[i], prefix))
+	}
+	return n
+}
+
+// schedulerExtender is a scheduler extender filtering and scoring nodes by
+// how well their free Habana modules, annotated by the device plugin, fit
+// the devices a pod requests. Nodes are taken from the scheduler's
+// requests, or from nodes when the scheduler only sends their names.
+type schedulerExtender struct {
+	log    *slog.Logger
+	prefix string
+	// requireContiguous filters out the nodes whose free modules only fit
+	// the devices scattered.
+	requireContiguous bool
+	nodes             corelisters.NodeLister
+}
+
+// nodeModules returns the module IDs of the node's devices and those of
+// them that are free, from its annotations.
+func (e *schedulerExtender) nodeModules(node *corev1.Node) (modules, free []int, err error) {
+	if modules, err = parseModules(node.Annotations[e.prefix+modulesAnnotation]); err != nil {
+		return nil, nil, fmt.Errorf("annotation %s%s: %w", e.prefix, modulesAnnotation, err)
+	}
+	if free, err = parseModules(node.Annotations[e.prefix+freeModulesAnnotation]); err != nil {
+		return nil, nil, fmt.Errorf("annotation %s%s: %w", e.prefix, freeModulesAnnotation, err)
+	}
+	return modules, free, nil
+}
+
+// candidates returns the nodes of args.
+func (e *schedulerExtender) candidates(args *extenderv1.ExtenderArgs) ([]*corev1.Node, error) {
+	if args.Nodes != nil {
+		nodes := make([]*corev1.Node, len(args.Nodes.Items))
+		for i := range args.Nodes.Items {
+			nodes[i] = &args.Nodes.Items[i]
+		}
+		return nodes, nil
+	}
+	if args.NodeNames == nil {
+		return nil, nil
+	}
+	nodes := make([]*corev1.Node, 0, len(*args.NodeNames))
+	for _, name := range *args.NodeNames {
+		node, err := e.nodes.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed getting node %s: %w", name, err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// filter keeps the nodes with enough free modules for the pod, reporting
+// why the others don't fit. Nodes that don't have enough modules at all
+// can't be made to fit by preempting pods.
+func (e *schedulerExtender) filter(args *extenderv1.ExtenderArgs) *extenderv1.ExtenderFilterResult {
+	nodes, err := e.candidates(args)
+	if err != nil {
+		return &extenderv1.ExtenderFilterResult{Error: err.Error()}
+	}
+	n := podDevices(args.Pod, e.prefix)
+
+	result := &extenderv1.ExtenderFilterResult{
+		FailedNodes:                make(extenderv1.FailedNodesMap),
+		FailedAndUnresolvableNodes: make(extenderv1.FailedNodesMap),
+	}
+	var fit []*corev1.Node
+	for _, node := range nodes {
+		if n == 0 {
+			fit = append(fit, node)
+			continue
+		}
+		modules, free, err := e.nodeModules(node)
+		if err != nil {
+			result.FailedAndUnresolvableNodes[node.Name] = err.Error()
+			continue
+		}
+		switch score := placement(modules, free, n); {
+		case len(modules) < n:
+			result.FailedAndUnresolvableNodes[node.Name] = fmt.Sprintf("node has %d Habana modules, %d requested", len(modules), n)
+		case score == 0:
+			result.FailedNodes[node.Name] = fmt.Sprintf("node has %d free Habana modules, %d requested", len(free), n)
+		case score < placementContiguous && e.requireContiguous:
+			result.FailedNodes[node.Name] = fmt.Sprintf("node has no %d contiguous free Habana modules", n)
+		default:
+			fit = append(fit, node)
+		}
+	}
+
+	if args.Nodes != nil {
+		result.Nodes = &corev1.NodeList{}
+		for _, node := range fit {
+			result.Nodes.Items = append(result.Nodes.Items, *node)
+		}
+	} else {
+		names := make([]string, 0, len(fit))
+		for _, node := range fit {
+			names = append(names, node.Name)
+		}
+		result.NodeNames = &names
+	}
+	e.log.Debug("Filtered nodes", "namespace", args.Pod.Namespace, "pod", args.Pod.Name, "devices", n,
+		"nodes", len(nodes), "fit", len(fit))
+	return result
+}
+
+// prioritize scores the nodes by how well their free modules fit the pod.
+// Nodes the pod doesn't fit, or that don't have devices, score 0.
+func (e *schedulerExtender) prioritize(args *extenderv1.ExtenderArgs) (extenderv1.HostPriorityList, error) {
+	nodes, err := e.candidates(args)
+	if err != nil {
+		return nil, err
+	}
+	n := podDevices(args.Pod, e.prefix)
+
+	scores := make(extenderv1.HostPriorityList, 0, len(nodes))
+	for _, node := range nodes {
+		var score int64
+		if modules, free, err := e.nodeModules(node); err == nil {
+			score = placement(modules, free, n)
+		}
+		scores = append(scores, extenderv1.HostPriority{Host: node.Name, Score: score})
+	}
+	return scores, nil
+}
+
+// ServeHTTP serves the filter and prioritize verbs of the scheduler
+// extender API.
+func (e *schedulerExtender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var args extenderv1.ExtenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil || args.Pod == nil {
+		http.Error(w, "invalid extender arguments", http.StatusBadRequest)
+		return
+	}
+
+	var resp any
+	switch r.URL.Path {
+	case "/filter":
+		resp = e.filter(&args)
+	case "/prioritize":
+		scores, err := e.prioritize(&args)
+		if err != nil {
+			e.log.Error("Failed scoring nodes", "namespace", args.Pod.Namespace, "pod", args.Pod.Name, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp = scores
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// newSchedulerExtenderService returns the scheduler extender served on
+// cfg.ExtenderAddr, reading the nodes from an informer cache.
+func newSchedulerExtenderService(log *slog.Logger, cfg *ClusterConfig, clients *kubeClients) (*clusterService, error) {
+	client, err := clients.clientset()
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactory(client, 0)
+	extender := &schedulerExtender{
+		log:               log,
+		prefix:            cfg.ResourcePrefix,
+		requireContiguous: cfg.ExtenderRequireContiguous,
+		nodes:             factory.Core().V1().Nodes().Lister(),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/filter", extender)
+	mux.Handle("/prioritize", extender)
+	return &clusterService{
+		name:    "scheduler extender",
+		addr:    cfg.ExtenderAddr,
+		handler: mux,
+		sync: func(ctx context.Context) error {
+			factory.Start(ctx.Done())
+			for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+				if !synced && ctx.Err() == nil {
+					return fmt.Errorf("failed syncing %v cache", typ)
+				}
+			}
+			return nil
+		},
+		run: func(ctx context.Context) {
+			<-ctx.Done()
+			factory.Shutdown()
+		},
+	}, nil
+}
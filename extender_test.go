@@ -0,0 +1,206 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+func TestPlacement(t *testing.T) {
+	all := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	for _, tc := range []struct {
+		name          string
+		modules, free []int
+		n             int
+		want          int64
+	}{
+		{"aligned block", all, []int{0, 1, 2, 3}, 4, placementAligned},
+		{"aligned pair", all, []int{1, 2, 3, 6, 7}, 2, placementAligned},
+		{"rounded up block", all, []int{4, 5, 6}, 3, placementAligned},
+		{"contiguous across blocks", all, []int{1, 2, 3, 4}, 4, placementContiguous},
+		// The node lacks module 0, so 0-3 isn't a complete block.
+		{"incomplete block", []int{1, 2, 3, 4}, []int{1, 2, 3, 4}, 4, placementContiguous},
+		{"scattered", all, []int{0, 2, 4, 6}, 2, placementScattered},
+		{"not enough free", all, []int{0, 1}, 4, 0},
+		{"no devices requested", all, all, 0, 0},
+		{"no modules", nil, nil, 1, 0},
+	} {
+		if got := placement(tc.modules, tc.free, tc.n); got != tc.want {
+			t.Errorf("%s: placement(%v, %v, %d) = %d, want %d", tc.name, tc.modules, tc.free, tc.n, got, tc.want)
+		}
+	}
+}
+
+// gaudiPod returns a pod whose containers request the devices of counts,
+// and whose init containers those of initCounts.
+func gaudiPod(counts, initCounts []int64) *corev1.Pod {
+	container := func(n int64) corev1.Container {
+		return corev1.Container{Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{"habana.ai/gaudi": *resource.NewQuantity(n, resource.DecimalSI)},
+		}}
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ml", Name: "train"}}
+	for _, n := range counts {
+		pod.Spec.Containers = append(pod.Spec.Containers, container(n))
+	}
+	for _, n := range initCounts {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, container(n))
+	}
+	return pod
+}
+
+func TestPodDevices(t *testing.T) {
+	for _, tc := range []struct {
+		counts, initCounts []int64
+		want               int
+	}{
+		{[]int64{2, 1}, nil, 3},
+		// Init containers run before the others, one at a time.
+		{[]int64{2, 1}, []int64{2, 2}, 3},
+		{[]int64{2, 1}, []int64{4, 1}, 4},
+		{nil, nil, 0},
+	} {
+		if got := podDevices(gaudiPod(tc.counts, tc.initCounts), "habana.ai/"); got != tc.want {
+			t.Errorf("podDevices(%v, init %v) = %d, want %d", tc.counts, tc.initCounts, got, tc.want)
+		}
+	}
+
+	// Requests count too, and other resources don't.
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Resources: corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{"habana.ai/gaudi2": resource.MustParse("2"), corev1.ResourceCPU: resource.MustParse("8")},
+	}}}}}
+	if got := podDevices(pod, "habana.ai/"); got != 2 {
+		t.Errorf("podDevices() of requests = %d, want 2", got)
+	}
+}
+
+func TestSchedulerExtender(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := func(name, modules, free string) corev1.Node {
+		return corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+			"habana.ai/modules":      modules,
+			"habana.ai/free-modules": free,
+		}}}
+	}
+	nodes := []corev1.Node{
+		node("aligned", "0,1,2,3,4,5,6,7", "4,5,6,7"),
+		node("contiguous", "0,1,2,3,4,5,6,7", "2,3,4,5"),
+		node("scattered", "0,1,2,3,4,5,6,7", "0,2,5,7"),
+		node("busy", "0,1,2,3,4,5,6,7", "0,1"),
+		node("small", "0,1", "0,1"),
+		node("invalid", "0,x", ""),
+		{ObjectMeta: metav1.ObjectMeta{Name: "cpu"}},
+	}
+	names := make([]string, len(nodes))
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range nodes {
+		names[i] = nodes[i].Name
+		if err := indexer.Add(&nodes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &schedulerExtender{log: logs.Logger(), prefix: "habana.ai/", nodes: corelisters.NewNodeLister(indexer)}
+	pod := gaudiPod([]int64{4}, nil)
+
+	wantFailed := []string{"busy"}
+	wantUnresolvable := []string{"cpu", "invalid", "small"}
+	check := func(t *testing.T, result *extenderv1.ExtenderFilterResult, fit []string, wantFit []string) {
+		t.Helper()
+		if result.Error != "" {
+			t.Fatalf("filter() error = %s", result.Error)
+		}
+		if !slices.Equal(fit, wantFit) {
+			t.Errorf("fit %v, want %v", fit, wantFit)
+		}
+		if got := slices.Sorted(maps.Keys(result.FailedNodes)); !slices.Equal(got, wantFailed) {
+			t.Errorf("failed nodes %v, want %v", result.FailedNodes, wantFailed)
+		}
+		if got := slices.Sorted(maps.Keys(result.FailedAndUnresolvableNodes)); !slices.Equal(got, wantUnresolvable) {
+			t.Errorf("failed and unresolvable nodes %v, want %v", result.FailedAndUnresolvableNodes, wantUnresolvable)
+		}
+	}
+
+	t.Run("nodes", func(t *testing.T) {
+		result := e.filter(&extenderv1.ExtenderArgs{Pod: pod, Nodes: &corev1.NodeList{Items: nodes}})
+		if result.NodeNames != nil || result.Nodes == nil {
+			t.Fatalf("filter() answered node names %v to nodes", result.NodeNames)
+		}
+		var fit []string
+		for _, n := range result.Nodes.Items {
+			fit = append(fit, n.Name)
+		}
+		check(t, result, fit, []string{"aligned", "contiguous", "scattered"})
+	})
+	t.Run("node names", func(t *testing.T) {
+		result := e.filter(&extenderv1.ExtenderArgs{Pod: pod, NodeNames: &names})
+		if result.Nodes != nil || result.NodeNames == nil {
+			t.Fatalf("filter() answered nodes %v to node names", result.Nodes)
+		}
+		check(t, result, *result.NodeNames, []string{"aligned", "contiguous", "scattered"})
+
+		unknown := append(slices.Clone(names), "gone")
+		if result := e.filter(&extenderv1.ExtenderArgs{Pod: pod, NodeNames: &unknown}); result.Error == "" {
+			t.Error("filter() of an unknown node succeeded")
+		}
+	})
+	t.Run("require contiguous", func(t *testing.T) {
+		contiguous := *e
+		contiguous.requireContiguous = true
+		wantFailed = []string{"busy", "scattered"}
+		defer func() { wantFailed = []string{"busy"} }()
+		result := contiguous.filter(&extenderv1.ExtenderArgs{Pod: pod, NodeNames: &names})
+		check(t, result, *result.NodeNames, []string{"aligned", "contiguous"})
+	})
+	t.Run("no devices requested", func(t *testing.T) {
+		result := e.filter(&extenderv1.ExtenderArgs{Pod: gaudiPod(nil, nil), NodeNames: &names})
+		if !slices.Equal(*result.NodeNames, names) || len(result.FailedNodes)+len(result.FailedAndUnresolvableNodes) != 0 {
+			t.Errorf("filter() of a pod without devices = %+v, want every node", result)
+		}
+	})
+
+	t.Run("prioritize", func(t *testing.T) {
+		scores, err := e.prioritize(&extenderv1.ExtenderArgs{Pod: pod, NodeNames: &names})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := extenderv1.HostPriorityList{
+			{Host: "aligned", Score: placementAligned},
+			{Host: "contiguous", Score: placementContiguous},
+			{Host: "scattered", Score: placementScattered},
+			{Host: "busy"}, {Host: "small"}, {Host: "invalid"}, {Host: "cpu"},
+		}
+		if !slices.Equal(scores, want) {
+			t.Errorf("scores = %v, want %v", scores, want)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Reactions to a device failing under a running pod.
+const (
+	failedDeviceAnnotate = "annotate"
+	failedDeviceEvent    = "event"
+	failedDeviceEvict    = "evict"
+)
+
+// failedDeviceActions are the valid reactions, in the order they are
+// applied.
+var failedDeviceActions = []string{failedDeviceAnnotate, failedDeviceEvent, failedDeviceEvict}
+
+const (
+	// failedDeviceAnnotation, under the resource prefix, is set on pods
+	// using a failed device to the serial numbers of the failed devices.
+	failedDeviceAnnotation = "failed-devices"
+	// evictOptInAnnotation, under the resource prefix, must be "true" on a
+	// pod for it to be evicted when one of its devices fails.
+	evictOptInAnnotation = "evict-on-device-failure"
+	// eventDeviceFailed is the reason of the events recorded on pods using
+	// a failed device.
+	eventDeviceFailed = "HabanaDeviceFailed"
+)
+
+// parseFailedDeviceActions parses a comma-separated list of reactions.
+func parseFailedDeviceActions(s string) ([]string, error) {
+	var actions []string
+	for _, a := range strings.Split(s, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if !slices.Contains(failedDeviceActions, a) {
+			return nil, fmt.Errorf("unknown action %q, expected one of %s", a, strings.Join(failedDeviceActions, ", "))
+		}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// failedPod is a pod using a device that failed.
+type failedPod struct {
+	namespace, name string
+	device          string
+}
+
+// failedDeviceReactor reacts to devices failing under running pods, found
+// through the PodResources API, by annotating the pods, recording events
+// on them or evicting them. Evictions are limited to maxEvictions every
+// evictionInterval, and only pods opting in through an annotation are
+// evicted. Reactions run in the background by Run.
+type failedDeviceReactor struct {
+	log      *slog.Logger
+	client   kubernetes.Interface
+	recorder record.EventRecorder
+	pods     *podResources
+	prefix   string
+	actions  []string
+
+	maxEvictions     int
+	evictionInterval time.Duration
+	evictions        []time.Time
+	now              func() time.Time
+
+	// failed queues the serials of the devices that turned unhealthy.
+	failed chan string
+
+	mu sync.Mutex
+	// health is the last known health of every device by serial.
+	health map[string]string
+}
+
+func newFailedDeviceReactor(log *slog.Logger, client kubernetes.Interface, recorder record.EventRecorder, pods *podResources, prefix string, actions []string, maxEvictions int, evictionInterval time.Duration) *failedDeviceReactor {
+	return &failedDeviceReactor{
+		log:              log,
+		client:           client,
+		recorder:         recorder,
+		pods:             pods,
+		prefix:           prefix,
+		actions:          actions,
+		maxEvictions:     maxEvictions,
+		evictionInterval: evictionInterval,
+		now:              time.Now,
+		failed:           make(chan string, 64),
+		health:           make(map[string]string),
+	}
+}
+
+// DevicesChanged queues the devices that turned unhealthy.
+func (r *failedDeviceReactor) DevicesChanged(_ nodeFeatures, devs []*pluginapi.Device) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]string, len(devs))
+	for _, d := range devs {
+		seen[d.ID] = d.Health
+		if d.Health == pluginapi.Healthy || r.health[d.ID] == d.Health {
+			continue
+		}
+		select {
+		case r.failed <- d.ID:
+		default:
+			r.log.Error("Too many failed devices pending, not reacting to one", "id", d.ID)
+		}
+	}
+	r.health = seen
+}
+
+// Run reacts to the queued device failures until ctx is done. The pods
+// using a device are listed from kubelet again first, as the device may
+// have been allocated since the last listing.
+func (r *failedDeviceReactor) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-r.failed:
+			if err := r.pods.Sync(ctx); err != nil {
+				r.log.Warn("Failed listing pod resources, using the last known ones", "id", id, "error", err)
+			}
+			for _, pod := range r.pods.Pods(id) {
+				r.react(ctx, failedPod{namespace: pod.Namespace, name: pod.Name, device: id})
+			}
+		}
+	}
+}
+
+// react applies every configured reaction to p. A failing reaction is
+// logged and doesn't prevent the next ones.
+func (r *failedDeviceReactor) react(ctx context.Context, p failedPod) {
+	log := r.log.With("namespace", p.namespace, "pod", p.name, "id", p.device)
+	log.Warn("Device failed under a running pod")
+
+	pod, err := r.client.CoreV1().Pods(p.namespace).Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		log.Error("Failed getting pod using a failed device, not reacting", "error", err)
+		return
+	}
+	for _, action := range r.actions {
+		var err error
+		switch action {
+		case failedDeviceAnnotate:
+			err = r.annotate(ctx, pod, p.device)
+		case failedDeviceEvent:
+			ref := &corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+			r.recorder.Eventf(ref, corev1.EventTypeWarning, eventDeviceFailed, "Habana device %s used by the pod failed", p.device)
+		case failedDeviceEvict:
+			err = r.evict(ctx, log, pod)
+		}
+		if err != nil {
+			log.Error("Failed reacting to device failure", "action", action, "error", err)
+		}
+	}
+}
+
+// annotate adds the failed device to the annotation of the pod listing
+// them.
+func (r *failedDeviceReactor) annotate(ctx context.Context, pod *corev1.Pod, device string) error {
+	key := r.prefix + failedDeviceAnnotation
+	var failed []string
+	if v := pod.Annotations[key]; v != "" {
+		failed = strings.Split(v, ",")
+	}
+	if slices.Contains(failed, device) {
+		return nil
+	}
+	failed = append(failed, device)
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": map[string]string{key: strings.Join(failed, ",")}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := r.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed annotating pod: %w", err)
+	}
+	return nil
+}
+
+// evict evicts the pod through the Eviction API, which honors its
+// disruption budget, if it opted in and the eviction limit allows it.
+func (r *failedDeviceReactor) evict(ctx context.Context, log *slog.Logger, pod *corev1.Pod) error {
+	if pod.Annotations[r.prefix+evictOptInAnnotation] != "true" {
+		log.Info("Not evicting pod, it did not opt in", "annotation", r.prefix+evictOptInAnnotation)
+		return nil
+	}
+
+	now := r.now()
+	r.evictions = slices.DeleteFunc(r.evictions, func(t time.Time) bool { return now.Sub(t) >= r.evictionInterval })
+	if len(r.evictions) >= r.maxEvictions {
+		log.Warn("Not evicting pod, eviction limit reached",
+			"max_evictions", r.maxEvictions, "interval", r.evictionInterval)
+		return nil
+	}
+
+	// The UID precondition keeps a pod recreated under the same name.
+	err := r.client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		DeleteOptions: &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pod.UID}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed evicting pod: %w", err)
+	}
+	r.evictions = append(r.evictions, now)
+	log.Warn("Evicted pod using a failed device")
+	return nil
+}
@@ -0,0 +1,190 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// refRecorder records the events and the objects they are about.
+type refRecorder struct {
+	events []string
+}
+
+func (r *refRecorder) Event(object runtime.Object, eventType, reason, message string) {
+	ref := object.(*corev1.ObjectReference)
+	r.events = append(r.events, fmt.Sprintf("%s %s %s/%s %s %s: %s", eventType, ref.Kind, ref.Namespace, ref.Name, ref.UID, reason, message))
+}
+
+func (r *refRecorder) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	r.Event(object, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *refRecorder) AnnotatedEventf(object runtime.Object, _ map[string]string, eventType, reason, messageFmt string, args ...any) {
+	r.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+func TestFailedDeviceReactor(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ml", Name: name, UID: types.UID("uid-" + name), Annotations: annotations,
+		}}
+	}
+	optIn := "habana.ai/" + evictOptInAnnotation
+	client := fake.NewSimpleClientset(
+		pod("train", map[string]string{optIn: "true", "habana.ai/failed-devices": "A", "owner": "ml-team"}),
+		pod("serve", map[string]string{optIn: "true"}),
+		pod("batch", map[string]string{optIn: "false"}),
+	)
+	// evicted lists the pods evicted, with the UID they were required to
+	// have.
+	var evicted []string
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		create := action.(k8stesting.CreateAction)
+		if create.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		e := create.GetObject().(*policyv1.Eviction)
+		evicted = append(evicted, e.Name+" "+string(*e.DeleteOptions.Preconditions.UID))
+		return true, e, nil
+	})
+	recorder := &refRecorder{}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	actions := []string{failedDeviceAnnotate, failedDeviceEvent, failedDeviceEvict}
+	r := newFailedDeviceReactor(logs.Logger(), client, recorder, nil, "habana.ai/", actions, 1, 10*time.Minute)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	getPod := func(name string) *corev1.Pod {
+		p, err := client.CoreV1().Pods("ml").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	patches := func() []string {
+		var patches []string
+		for _, a := range client.Actions() {
+			if p, ok := a.(k8stesting.PatchAction); ok {
+				if p.GetPatchType() != types.MergePatchType {
+					t.Errorf("pod patched with a %s patch", p.GetPatchType())
+				}
+				patches = append(patches, p.GetName()+" "+string(p.GetPatch()))
+			}
+		}
+		client.ClearActions()
+		return patches
+	}
+
+	// The failed device is added to the annotation, the other annotations
+	// are kept, an event is recorded on the pod, and it's evicted.
+	r.react(ctx, failedPod{namespace: "ml", name: "train", device: "B"})
+	if got := getPod("train").Annotations; got["habana.ai/failed-devices"] != "A,B" || got["owner"] != "ml-team" {
+		t.Errorf("annotations = %v, want A,B failed and the owner kept", got)
+	}
+	if got, want := patches(), []string{`train {"metadata":{"annotations":{"habana.ai/failed-devices":"A,B"}}}`}; !slices.Equal(got, want) {
+		t.Errorf("patches = %v, want %v", got, want)
+	}
+	if want := []string{"Warning Pod ml/train uid-train HabanaDeviceFailed: Habana device B used by the pod failed"}; !slices.Equal(recorder.events, want) {
+		t.Errorf("events = %v, want %v", recorder.events, want)
+	}
+	if want := []string{"train uid-train"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted %v, want %v", evicted, want)
+	}
+
+	// A device already listed isn't patched again.
+	r.react(ctx, failedPod{namespace: "ml", name: "train", device: "A"})
+	if got := patches(); len(got) != 0 {
+		t.Errorf("patches %v for a device already listed", got)
+	}
+
+	// A pod not opting in isn't evicted, nor is one past the limit.
+	evicted = nil
+	r.react(ctx, failedPod{namespace: "ml", name: "batch", device: "C"})
+	r.react(ctx, failedPod{namespace: "ml", name: "serve", device: "C"})
+	if len(evicted) != 0 {
+		t.Errorf("evicted %v, want none", evicted)
+	}
+	if got := getPod("serve").Annotations["habana.ai/failed-devices"]; got != "C" {
+		t.Errorf("failed devices of serve = %q, want C", got)
+	}
+
+	// Once the interval has passed, evicting is allowed again.
+	now = now.Add(10 * time.Minute)
+	r.react(ctx, failedPod{namespace: "ml", name: "serve", device: "C"})
+	if want := []string{"serve uid-serve"}; !slices.Equal(evicted, want) {
+		t.Errorf("evicted %v after the interval, want %v", evicted, want)
+	}
+
+	// A pod gone meanwhile gets no reaction.
+	recorder.events = nil
+	r.react(ctx, failedPod{namespace: "ml", name: "gone", device: "C"})
+	if len(recorder.events) != 0 {
+		t.Errorf("events %v for a missing pod", recorder.events)
+	}
+}
+
+func TestFailedDeviceReactorQueue(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newFailedDeviceReactor(logs.Logger(), nil, nil, nil, "habana.ai/", []string{failedDeviceEvent}, 1, time.Minute)
+	dev := func(id, health string) *pluginapi.Device { return &pluginapi.Device{ID: id, Health: health} }
+	queued := func() []string {
+		var ids []string
+		for {
+			select {
+			case id := <-r.failed:
+				ids = append(ids, id)
+			default:
+				return ids
+			}
+		}
+	}
+
+	r.DevicesChanged(nodeFeatures{}, []*pluginapi.Device{dev("A", pluginapi.Healthy), dev("B", pluginapi.Unhealthy)})
+	if got := queued(); !slices.Equal(got, []string{"B"}) {
+		t.Errorf("queued %v, want B", got)
+	}
+	// Only devices turning unhealthy are queued.
+	r.DevicesChanged(nodeFeatures{}, []*pluginapi.Device{dev("A", pluginapi.Unhealthy), dev("B", pluginapi.Unhealthy)})
+	if got := queued(); !slices.Equal(got, []string{"A"}) {
+		t.Errorf("queued %v, want A", got)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceHealthUnknown is the health of the devices of nodes that are gone
+// or not ready, whose plugin can't be trusted to report it, and of those
+// their plugin no longer serves.
+const deviceHealthUnknown = "Unknown"
+
+// fleetDevice is a HabanaDevice in the fleet summary.
+type fleetDevice struct {
+	Name string `json:"name"`
+	habanaDeviceStatus
+}
+
+// fleetSummary aggregates the HabanaDevices of the cluster.
+type fleetSummary struct {
+	Devices int `json:"devices"`
+	// Health counts the devices by health, InUse those used by pods.
+	Health map[string]int `json:"health"`
+	InUse  int            `json:"inUse"`
+	// UnhealthyNodes counts the devices not healthy, by node.
+	UnhealthyNodes map[string]int `json:"unhealthyNodes,omitempty"`
+	Items          []fleetDevice  `json:"items"`
+}
+
+// summarizeFleet aggregates the HabanaDevices objs. Devices of nodes
+// missing from nodes, or not ready, are counted as of unknown health.
+func summarizeFleet(objs []*unstructured.Unstructured, nodes map[string]*corev1.Node) fleetSummary {
+	s := fleetSummary{
+		Health:         make(map[string]int),
+		UnhealthyNodes: make(map[string]int),
+		Items:          make([]fleetDevice, 0, len(objs)),
+	}
+	for _, obj := range objs {
+		d := fleetDevice{Name: obj.GetName()}
+		if raw, ok := obj.Object["status"].(map[string]any); ok {
+			_ = runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &d.habanaDeviceStatus) // counted as unknown
+		}
+		if node, ok := nodes[d.Node]; !ok || !nodeReady(node) || d.Health == "" {
+			d.Health = deviceHealthUnknown
+		}
+
+		s.Devices++
+		s.Health[d.Health]++
+		if len(d.Pods) > 0 {
+			s.InUse++
+		}
+		if d.Health != pluginapi.Healthy && d.Node != "" {
+			s.UnhealthyNodes[d.Node]++
+		}
+		s.Items = append(s.Items, d)
+	}
+	slices.SortFunc(s.Items, func(a, b fleetDevice) int {
+		return cmp.Or(cmp.Compare(a.Node, b.Node), cmp.Compare(a.Name, b.Name))
+	})
+	return s
+}
+
+// nodeReady reports whether the Ready condition of node is true.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// healthController watches the HabanaDevices reported by the device
+// plugins of the cluster, logging health transitions and exporting the
+// fleet status as metrics and on the admin server's /devices endpoint.
+type healthController struct {
+	log     *slog.Logger
+	devices cache.GenericLister
+	nodes   corelisters.NodeLister
+	synced  []cache.InformerSynced
+	start   func(stop <-chan struct{})
+	stop    func()
+	// changed is signaled when devices or nodes changed.
+	changed chan struct{}
+
+	mu      sync.Mutex
+	summary fleetSummary
+}
+
+func newHealthController(log *slog.Logger, client dynamic.Interface, kube kubernetes.Interface) (*healthController, error) {
+	deviceFactory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	nodeFactory := informers.NewSharedInformerFactory(kube, 0)
+	devices := deviceFactory.ForResource(habanaDeviceResource)
+	nodes := nodeFactory.Core().V1().Nodes()
+
+	c := &healthController{
+		log:     log,
+		devices: devices.Lister(),
+		nodes:   nodes.Lister(),
+		synced:  []cache.InformerSynced{devices.Informer().HasSynced, nodes.Informer().HasSynced},
+		start: func(stop <-chan struct{}) {
+			deviceFactory.Start(stop)
+			nodeFactory.Start(stop)
+		},
+		stop: func() {
+			deviceFactory.Shutdown()
+			nodeFactory.Shutdown()
+		},
+		changed: make(chan struct{}, 1),
+	}
+	if _, err := devices.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.notify() },
+		UpdateFunc: c.deviceUpdated,
+		DeleteFunc: func(any) { c.notify() },
+	}); err != nil {
+		return nil, fmt.Errorf("failed watching Habana devices: %w", err)
+	}
+	if _, err := nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.notify() },
+		UpdateFunc: func(any, any) { c.notify() },
+		DeleteFunc: func(any) { c.notify() },
+	}); err != nil {
+		return nil, fmt.Errorf("failed watching nodes: %w", err)
+	}
+	return c, nil
+}
+
+func (c *healthController) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// deviceUpdated logs the health transitions of a HabanaDevice.
+func (c *healthController) deviceUpdated(oldObj, newObj any) {
+	defer c.notify()
+	o, ok1 := oldObj.(*unstructured.Unstructured)
+	n, ok2 := newObj.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		return
+	}
+	oldHealth, _, _ := unstructured.NestedString(o.Object, "status", "health")
+	newHealth, _, _ := unstructured.NestedString(n.Object, "status", "health")
+	if oldHealth == newHealth || oldHealth == "" {
+		return
+	}
+	node, _, _ := unstructured.NestedString(n.Object, "status", "node")
+	pods, _, _ := unstructured.NestedStringSlice(n.Object, "status", "pods")
+	if newHealth == pluginapi.Healthy {
+		c.log.Info("Habana device recovered", "device", n.GetName(), "node", node)
+	} else {
+		c.log.Warn("Habana device turned unhealthy", "device", n.GetName(), "node", node, "health", newHealth, "pods", pods)
+	}
+}
+
+// Start starts watching and waits for the caches to sync, or ctx to be
+// done.
+func (c *healthController) Start(ctx context.Context) error {
+	c.start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) && ctx.Err() == nil {
+		return fmt.Errorf("failed syncing Habana device and node caches")
+	}
+	c.notify()
+	return nil
+}
+
+// Run aggregates the fleet status whenever devices or nodes change, until
+// ctx is done.
+func (c *healthController) Run(ctx context.Context) {
+	defer c.stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.changed:
+			if err := c.refresh(); err != nil {
+				c.log.Error("Failed aggregating Habana device status", "error", err)
+			}
+		}
+	}
+}
+
+// refresh aggregates the fleet status from the caches.
+func (c *healthController) refresh() error {
+	objs, err := c.devices.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	devices := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			devices = append(devices, u)
+		}
+	}
+	nodeList, err := c.nodes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	nodes := make(map[string]*corev1.Node, len(nodeList))
+	for _, node := range nodeList {
+		nodes[node.Name] = node
+	}
+
+	s := summarizeFleet(devices, nodes)
+	updateFleetMetrics(s)
+	c.mu.Lock()
+	c.summary = s
+	c.mu.Unlock()
+	c.log.Debug("Aggregated Habana device status", "devices", s.Devices, "health", s.Health, "in_use", s.InUse)
+	return nil
+}
+
+// Summary returns the last fleet status aggregated.
+func (c *healthController) Summary() fleetSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.summary
+}
+
+// ServeHTTP serves the fleet status as JSON.
+func (c *healthController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = writeJSON(w, c.Summary())
+}
+
+// newHealthControllerService returns the fleet health controller, whose
+// status the admin server serves.
+func newHealthControllerService(log *slog.Logger, _ *ClusterConfig, clients *kubeClients) (*clusterService, error) {
+	client, err := clients.dynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	kube, err := clients.clientset()
+	if err != nil {
+		return nil, err
+	}
+	controller, err := newHealthController(log, client, kube)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterService{
+		name:   "device health controller",
+		status: controller,
+		sync:   controller.Start,
+		run:    controller.Run,
+	}, nil
+}
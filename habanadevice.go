@@ -0,0 +1,364 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// habanaDeviceResource is the HabanaDevice custom resource, a cluster
+// scoped object per physical card named after its serial number.
+var habanaDeviceResource = schema.GroupVersionResource{
+	Group:    "habana.ai",
+	Version:  "v1alpha1",
+	Resource: "habanadevices",
+}
+
+// deviceErrorMessage is the last error of a device turning unhealthy
+// without the health check telling why.
+const deviceErrorMessage = "Device was marked unhealthy"
+
+// habanaDeviceStatus is the status of a HabanaDevice.
+type habanaDeviceStatus struct {
+	Node               string             `json:"node"`
+	Serial             string             `json:"serial"`
+	Model              string             `json:"model,omitempty"`
+	ModuleID           *int64             `json:"moduleID,omitempty"`
+	NUMANode           *int64             `json:"numaNode,omitempty"`
+	Health             string             `json:"health"`
+	LastTransitionTime metav1.Time        `json:"lastTransitionTime,omitzero"`
+	LastError          *habanaDeviceError `json:"lastError,omitempty"`
+	// Pods are the pods using the device, as namespace/name.
+	Pods []string `json:"pods,omitempty"`
+}
+
+// habanaDeviceError is the last error of a HabanaDevice.
+type habanaDeviceError struct {
+	Time    metav1.Time `json:"time"`
+	Message string      `json:"message"`
+}
+
+// continuing returns s keeping the transition time of prev when the health
+// didn't change since and, unless s has one, the last error of prev.
+func (s habanaDeviceStatus) continuing(prev habanaDeviceStatus) habanaDeviceStatus {
+	if s.Health == prev.Health {
+		s.LastTransitionTime = prev.LastTransitionTime
+	}
+	if s.LastError == nil {
+		s.LastError = prev.LastError
+	}
+	return s
+}
+
+func (s habanaDeviceStatus) equal(o habanaDeviceStatus) bool {
+	return s.Node == o.Node && s.Serial == o.Serial && s.Model == o.Model &&
+		ptrEqual(s.ModuleID, o.ModuleID) && ptrEqual(s.NUMANode, o.NUMANode) &&
+		s.Health == o.Health && s.LastTransitionTime.Equal(&o.LastTransitionTime) &&
+		s.LastError.equal(o.LastError) && slices.Equal(s.Pods, o.Pods)
+}
+
+// equal reports whether e and o are both nil or the same error, whatever
+// the location of their times.
+func (e *habanaDeviceError) equal(o *habanaDeviceError) bool {
+	return e == o || (e != nil && o != nil && e.Message == o.Message && e.Time.Equal(&o.Time))
+}
+
+// ptrEqual reports whether a and b are both nil or point to equal values.
+func ptrEqual[T comparable](a, b *T) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// habanaDeviceName returns the name of the HabanaDevice of the device with
+// serial number serial.
+func habanaDeviceName(serial string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, serial)
+}
+
+// deviceHealthState is the health of a device as last seen by the
+// reporter.
+type deviceHealthState struct {
+	health    string
+	since     time.Time
+	lastError *habanaDeviceError
+}
+
+// deviceStatusReporter keeps the HabanaDevice of every device of the node
+// up to date: identifiers, health, last error and the pods using it. A
+// device the node no longer serves is reported with an unknown health. The
+// objects are owned by the Node, so they are deleted with it. As
+// assignments change without the devices changing, the statuses are
+// refreshed every interval too. Updates are applied in the background by
+// Run.
+type deviceStatusReporter struct {
+	log      *slog.Logger
+	client   dynamic.Interface
+	kube     kubernetes.Interface
+	nodeName string
+	pods     *podResources
+	interval time.Duration
+	updates  *latestUpdate[[]habanaDeviceStatus]
+	now      func() time.Time
+
+	mu       sync.Mutex
+	features nodeFeatures
+	devs     []*pluginapi.Device
+	health   map[string]deviceHealthState
+	// failures are the errors of the devices the health check failed, until
+	// DevicesChanged sees them unhealthy.
+	failures map[string]habanaDeviceError
+	// last holds the statuses last handed to updates.
+	last []habanaDeviceStatus
+
+	// owner references the Node and applied holds the statuses applied,
+	// by serial. They are only used by Run.
+	owner   *metav1.OwnerReference
+	applied map[string]habanaDeviceStatus
+}
+
+func newDeviceStatusReporter(log *slog.Logger, client dynamic.Interface, kube kubernetes.Interface, nodeName string, pods *podResources, interval time.Duration) *deviceStatusReporter {
+	return &deviceStatusReporter{
+		log:      log,
+		client:   client,
+		kube:     kube,
+		nodeName: nodeName,
+		pods:     pods,
+		interval: interval,
+		updates:  newLatestUpdate[[]habanaDeviceStatus](),
+		now:      time.Now,
+		health:   make(map[string]deviceHealthState),
+		failures: make(map[string]habanaDeviceError),
+		applied:  make(map[string]habanaDeviceStatus),
+	}
+}
+
+// DeviceFailed records why the device id failed, its last error once
+// DevicesChanged sees it unhealthy.
+func (r *deviceStatusReporter) DeviceFailed(id, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[id] = habanaDeviceError{Time: metav1.NewTime(r.now()), Message: reason}
+}
+
+// DevicesChanged schedules updating the HabanaDevices of devs.
+func (r *deviceStatusReporter) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	r.mu.Lock()
+	r.features, r.devs = features, devs
+	now := r.now()
+	for _, d := range devs {
+		failure, failed := r.failures[d.ID]
+		delete(r.failures, d.ID)
+		state, ok := r.health[d.ID]
+		if ok && state.health == d.Health {
+			continue
+		}
+		state.health, state.since = d.Health, now
+		switch {
+		case d.Health == pluginapi.Healthy:
+		case failed:
+			state.lastError = &failure
+		case ok:
+			state.lastError = &habanaDeviceError{Time: metav1.NewTime(now), Message: deviceErrorMessage}
+		}
+		r.health[d.ID] = state
+	}
+	// The devices no longer served, off the bus or left out by the deny
+	// list, have an unknown health until they are back.
+	for id, state := range r.health {
+		if state.health != deviceHealthUnknown && !slices.ContainsFunc(devs, func(d *pluginapi.Device) bool { return d.ID == id }) {
+			state.health, state.since = deviceHealthUnknown, now
+			r.health[id] = state
+		}
+	}
+	r.mu.Unlock()
+	r.refresh()
+}
+
+// Run updates the HabanaDevices until ctx is done.
+func (r *deviceStatusReporter) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Go(func() {
+		r.updates.Run(ctx, r.log.With("node", r.nodeName), "Failed updating Habana device objects, retrying", r.apply)
+	})
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refresh()
+		}
+	}
+}
+
+// refresh schedules updating the HabanaDevices when their statuses
+// changed.
+func (r *deviceStatusReporter) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]habanaDeviceStatus, 0, len(r.devs))
+	for _, d := range r.devs {
+		state := r.health[d.ID]
+		s := habanaDeviceStatus{
+			Node:               r.nodeName,
+			Serial:             d.ID,
+			Model:              r.features.model,
+			Health:             d.Health,
+			LastTransitionTime: metav1.NewTime(state.since),
+			LastError:          state.lastError,
+		}
+		if id, ok := r.features.moduleIDs[d.ID]; ok {
+			s.ModuleID = ptr(int64(id))
+		}
+		if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+			s.NUMANode = ptr(d.Topology.Nodes[0].ID)
+		}
+		for _, pod := range r.pods.Pods(d.ID) {
+			s.Pods = append(s.Pods, pod.Namespace+"/"+pod.Name)
+		}
+		statuses = append(statuses, s)
+	}
+	// A device no longer served keeps the identifiers last reported, and
+	// no pods.
+	for _, id := range slices.Sorted(maps.Keys(r.health)) {
+		state := r.health[id]
+		if state.health != deviceHealthUnknown {
+			continue
+		}
+		s := habanaDeviceStatus{Node: r.nodeName, Serial: id}
+		if i := slices.IndexFunc(r.last, func(s habanaDeviceStatus) bool { return s.Serial == id }); i >= 0 {
+			s = r.last[i]
+		}
+		s.Health, s.LastTransitionTime, s.LastError, s.Pods = deviceHealthUnknown, metav1.NewTime(state.since), state.lastError, nil
+		statuses = append(statuses, s)
+	}
+
+	if r.last != nil && slices.EqualFunc(r.last, statuses, habanaDeviceStatus.equal) {
+		return
+	}
+	r.last = statuses
+	r.updates.Set(statuses)
+}
+
+// apply creates or updates the HabanaDevices whose status changed since
+// last applied. A device keeps the last error last written, before the
+// plugin started too, until it has another, and its transition time while
+// its health doesn't change.
+func (r *deviceStatusReporter) apply(ctx context.Context, statuses []habanaDeviceStatus) error {
+	if r.owner == nil {
+		node, err := r.kube.CoreV1().Nodes().Get(ctx, r.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed getting node: %w", err)
+		}
+		r.owner = metav1.NewControllerRef(node, corev1.SchemeGroupVersion.WithKind("Node"))
+	}
+
+	var errs []error
+	for _, s := range statuses {
+		applied, ok := r.applied[s.Serial]
+		if ok {
+			if s = s.continuing(applied); applied.equal(s) {
+				continue
+			}
+		}
+		written, err := r.applyDevice(ctx, s, !ok)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", s.Serial, err))
+			continue
+		}
+		r.applied[s.Serial] = written
+	}
+	return errors.Join(errs...)
+}
+
+// applyDevice writes the HabanaDevice of s and returns the status written.
+// The first time, the status continues the one of the object.
+func (r *deviceStatusReporter) applyDevice(ctx context.Context, s habanaDeviceStatus, first bool) (habanaDeviceStatus, error) {
+	client := r.client.Resource(habanaDeviceResource)
+	name := habanaDeviceName(s.Serial)
+
+	obj, err := client.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		obj = &unstructured.Unstructured{}
+		obj.SetAPIVersion(habanaDeviceResource.GroupVersion().String())
+		obj.SetKind("HabanaDevice")
+		obj.SetName(name)
+		obj.SetOwnerReferences([]metav1.OwnerReference{*r.owner})
+		if obj, err = client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return s, fmt.Errorf("failed creating Habana device object: %w", err)
+		}
+	case err != nil:
+		return s, fmt.Errorf("failed getting Habana device object: %w", err)
+	default:
+		// The card moved to this node.
+		if refs := obj.GetOwnerReferences(); len(refs) != 1 || refs[0].UID != r.owner.UID {
+			obj.SetOwnerReferences([]metav1.OwnerReference{*r.owner})
+			if obj, err = client.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+				return s, fmt.Errorf("failed updating Habana device object: %w", err)
+			}
+		}
+	}
+
+	var cur habanaDeviceStatus
+	if raw, ok := obj.Object["status"].(map[string]any); ok {
+		_ = runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &cur) // a malformed status is replaced
+	}
+	if first {
+		s = s.continuing(cur)
+	}
+
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&s)
+	if err != nil {
+		return s, err
+	}
+	obj.Object["status"] = status
+	if _, err := client.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return s, fmt.Errorf("failed updating Habana device status: %w", err)
+	}
+	return s, nil
+}
@@ -0,0 +1,237 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	runtimeapi "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// habanaDeviceStatusOf returns the status of the HabanaDevice name.
+func habanaDeviceStatusOf(t *testing.T, client *dynamicfake.FakeDynamicClient, name string) (habanaDeviceStatus, *unstructured.Unstructured) {
+	t.Helper()
+	obj, err := client.Resource(habanaDeviceResource).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s habanaDeviceStatus
+	if err := runtimeapi.DefaultUnstructuredConverter.FromUnstructured(obj.Object["status"].(map[string]any), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s, obj
+}
+
+// statusWrites returns the HabanaDevices whose status was written by the
+// actions of client since the last call, by name.
+func statusWrites(client *dynamicfake.FakeDynamicClient) []string {
+	var names []string
+	for _, a := range client.Actions() {
+		if u, ok := a.(k8stesting.UpdateAction); ok && u.GetSubresource() == "status" {
+			names = append(names, u.GetObject().(*unstructured.Unstructured).GetName())
+		}
+	}
+	client.ClearActions()
+	return names
+}
+
+func TestDeviceStatusReporter(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakePodResources{pods: []*podresourcesapi.PodResources{{Name: "train", Namespace: "ml", Containers: []*podresourcesapi.ContainerResources{
+		{Name: "worker", Devices: []*podresourcesapi.ContainerDevices{{ResourceName: "habana.ai/gaudi", DeviceIds: []string{"AB01"}}}},
+	}}}}
+	pods := newPodResources(logs.Logger(), servePodResources(t, server), filepath.Join(t.TempDir(), "checkpoint"), "habana.ai/", time.Second, time.Minute)
+	ctx := context.Background()
+	if err := pods.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// AB02 was reported failed by the plugin before it restarted, from
+	// another node.
+	before := metav1.NewTime(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	oldError := &habanaDeviceError{Time: before, Message: "Critical error xid 2 reported by HLML"}
+	status, err := runtimeapi.DefaultUnstructuredConverter.ToUnstructured(&habanaDeviceStatus{
+		Node: "node-0", Serial: "AB02", Health: pluginapi.Unhealthy, LastTransitionTime: before, LastError: oldError,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := &unstructured.Unstructured{Object: map[string]any{"status": status}}
+	existing.SetAPIVersion("habana.ai/v1alpha1")
+	existing.SetKind("HabanaDevice")
+	existing.SetName("ab02")
+	existing.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "v1", Kind: "Node", Name: "node-0", UID: "node-0-uid"}})
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtimeapi.NewScheme(), map[schema.GroupVersionResource]string{
+		habanaDeviceResource: "HabanaDeviceList",
+	}, existing)
+	kube := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: types.UID("node-1-uid")}})
+
+	r := newDeviceStatusReporter(logs.Logger(), client, kube, "node-1", pods, time.Minute)
+	now := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	features := nodeFeatures{model: "HL-225", moduleIDs: map[string]uint{"AB01": 0, "AB02": 1}}
+	// publish applies the statuses the reporter scheduled.
+	publish := func() {
+		t.Helper()
+		r.mu.Lock()
+		statuses := r.last
+		r.mu.Unlock()
+		if err := r.apply(ctx, statuses); err != nil {
+			t.Fatalf("apply() = %v", err)
+		}
+	}
+
+	r.DevicesChanged(features, []*pluginapi.Device{
+		numaDevice("AB01", pluginapi.Healthy, 0),
+		numaDevice("AB02", pluginapi.Unhealthy, 1),
+	})
+	publish()
+	if got := statusWrites(client); !slices.Equal(got, []string{"ab01", "ab02"}) {
+		t.Errorf("statuses written %v, want both", got)
+	}
+	created, obj := habanaDeviceStatusOf(t, client, "ab01")
+	want := habanaDeviceStatus{
+		Node: "node-1", Serial: "AB01", Model: "HL-225", ModuleID: ptr(int64(0)), NUMANode: ptr(int64(0)),
+		Health: pluginapi.Healthy, LastTransitionTime: metav1.NewTime(now), Pods: []string{"ml/train"},
+	}
+	if !created.equal(want) {
+		t.Errorf("created status %+v, want %+v", created, want)
+	}
+	if refs := obj.GetOwnerReferences(); len(refs) != 1 || refs[0].UID != "node-1-uid" || refs[0].Kind != "Node" {
+		t.Errorf("owner references %v, want the node", refs)
+	}
+	// The card moved with its failure: the transition and error are kept.
+	moved, obj := habanaDeviceStatusOf(t, client, "ab02")
+	if moved.Node != "node-1" || !moved.LastTransitionTime.Equal(&before) || !moved.LastError.equal(oldError) {
+		t.Errorf("moved card status %+v, want node-1 with its transition time and last error kept", moved)
+	}
+	if refs := obj.GetOwnerReferences(); len(refs) != 1 || refs[0].UID != "node-1-uid" {
+		t.Errorf("moved card owner references %v, want the new node", refs)
+	}
+
+	// Nothing changed, nothing is written.
+	now = now.Add(time.Minute)
+	r.refresh()
+	publish()
+	if got := statusWrites(client); len(got) != 0 {
+		t.Errorf("statuses written %v without a change", got)
+	}
+
+	// The pod moves to AB02, whose kept transition time and error stay.
+	server.pods[0].Containers[0].Devices[0].DeviceIds = []string{"AB02"}
+	if err := pods.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.refresh()
+	publish()
+	if got := statusWrites(client); !slices.Equal(got, []string{"ab01", "ab02"}) {
+		t.Errorf("statuses written %v, want both", got)
+	}
+	if s, _ := habanaDeviceStatusOf(t, client, "ab02"); !s.LastTransitionTime.Equal(&before) || !s.LastError.equal(oldError) || !slices.Equal(s.Pods, []string{"ml/train"}) {
+		t.Errorf("status after the pods changed %+v, want the transition time and last error kept", s)
+	}
+	if s, _ := habanaDeviceStatusOf(t, client, "ab01"); !s.LastTransitionTime.Equal(&want.LastTransitionTime) || s.Pods != nil {
+		t.Errorf("status after the pods changed %+v, want no pods since %v", s, want.LastTransitionTime)
+	}
+
+	// AB01 fails: the error is the one of the health check.
+	now = now.Add(time.Minute)
+	r.DeviceFailed("AB01", "Critical error xid 2 reported by HLML")
+	r.DevicesChanged(features, []*pluginapi.Device{
+		numaDevice("AB01", pluginapi.Unhealthy, 0),
+		numaDevice("AB02", pluginapi.Unhealthy, 1),
+	})
+	publish()
+	if got := statusWrites(client); !slices.Equal(got, []string{"ab01"}) {
+		t.Errorf("statuses written %v, want the failed device's", got)
+	}
+	failedAt := metav1.NewTime(now)
+	wantError := &habanaDeviceError{Time: failedAt, Message: "Critical error xid 2 reported by HLML"}
+	if s, _ := habanaDeviceStatusOf(t, client, "ab01"); s.Health != pluginapi.Unhealthy || !s.LastTransitionTime.Equal(&failedAt) || !s.LastError.equal(wantError) {
+		t.Errorf("failed device status %+v, want unhealthy since %v with error %+v", s, failedAt, wantError)
+	}
+
+	// It recovers, keeping its last error.
+	now = now.Add(time.Minute)
+	r.DevicesChanged(features, []*pluginapi.Device{
+		numaDevice("AB01", pluginapi.Healthy, 0),
+		numaDevice("AB02", pluginapi.Unhealthy, 1),
+	})
+	publish()
+	if got := statusWrites(client); !slices.Equal(got, []string{"ab01"}) {
+		t.Errorf("statuses written %v, want the recovered device's", got)
+	}
+	recoveredAt := metav1.NewTime(now)
+	if s, _ := habanaDeviceStatusOf(t, client, "ab01"); s.Health != pluginapi.Healthy || !s.LastTransitionTime.Equal(&recoveredAt) || !s.LastError.equal(wantError) {
+		t.Errorf("recovered device status %+v, want healthy since %v with error %+v", s, recoveredAt, wantError)
+	}
+
+	// AB02 drops off the bus: it turns unknown without pods, keeping its
+	// identifiers and last error.
+	now = now.Add(time.Minute)
+	r.DevicesChanged(features, []*pluginapi.Device{numaDevice("AB01", pluginapi.Healthy, 0)})
+	publish()
+	if got := statusWrites(client); !slices.Equal(got, []string{"ab02"}) {
+		t.Errorf("statuses written %v, want the missing device's", got)
+	}
+	missingAt := metav1.NewTime(now)
+	wantMissing := habanaDeviceStatus{
+		Node: "node-1", Serial: "AB02", Model: "HL-225", ModuleID: ptr(int64(1)), NUMANode: ptr(int64(1)),
+		Health: deviceHealthUnknown, LastTransitionTime: missingAt, LastError: oldError,
+	}
+	if s, _ := habanaDeviceStatusOf(t, client, "ab02"); !s.equal(wantMissing) {
+		t.Errorf("missing device status %+v, want %+v", s, wantMissing)
+	}
+	now = now.Add(time.Minute)
+	r.refresh()
+	publish()
+	if got := statusWrites(client); len(got) != 0 {
+		t.Errorf("statuses written %v while the device stays missing", got)
+	}
+
+	// It comes back healthy.
+	r.DevicesChanged(features, []*pluginapi.Device{
+		numaDevice("AB01", pluginapi.Healthy, 0),
+		numaDevice("AB02", pluginapi.Healthy, 1),
+	})
+	publish()
+	backAt := metav1.NewTime(now)
+	if s, _ := habanaDeviceStatusOf(t, client, "ab02"); s.Health != pluginapi.Healthy || !s.LastTransitionTime.Equal(&backAt) || !slices.Equal(s.Pods, []string{"ml/train"}) {
+		t.Errorf("device back status %+v, want healthy since %v with its pod", s, backAt)
+	}
+}
@@ -22,12 +22,14 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 // ResourceManager interface
 type ResourceManager interface {
-	Devices() ([]*pluginapi.Device, error)
+	Devices(ctx context.Context) ([]*pluginapi.Device, error)
 }
 
 // DeviceManager string devType: GOYA / GAUDI
@@ -42,8 +44,15 @@ func NewDeviceManager(log *slog.Logger, devType string) *DeviceManager {
 }
 
 // Devices Get Habana Device
-func (dm *DeviceManager) Devices() ([]*pluginapi.Device, error) {
-	NumOfDevices, err := hlml.DeviceCount()
+func (dm *DeviceManager) Devices(ctx context.Context) ([]*pluginapi.Device, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "DeviceManager.Devices")
+	defer span.End()
+
+	var NumOfDevices uint
+	err := traceHLML(ctx, "DeviceCount", func() (err error) {
+		NumOfDevices, err = hlml.DeviceCount()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -52,27 +61,48 @@ func (dm *DeviceManager) Devices() ([]*pluginapi.Device, error) {
 
 	dm.log.Info("Discovering devices...")
 	for i := uint(0); i < NumOfDevices; i++ {
-		newDevice, err := hlml.DeviceHandleByIndex(i)
+		var newDevice Device
+		err := traceHLML(ctx, "DeviceHandleByIndex", func() (err error) {
+			newDevice, err = hlml.DeviceHandleByIndex(i)
+			return err
+		}, attribute.Int("index", int(i)))
 		if err != nil {
 			return nil, err
 		}
 
-		pciID, err := newDevice.PCIID()
+		var pciID uint
+		err = traceHLML(ctx, "PCIID", func() (err error) {
+			pciID, err = newDevice.PCIID()
+			return err
+		}, attribute.Int("index", int(i)))
 		if err != nil {
 			return nil, err
 		}
 
-		serial, err := newDevice.SerialNumber()
+		var serial string
+		err = traceHLML(ctx, "SerialNumber", func() (err error) {
+			serial, err = newDevice.SerialNumber()
+			return err
+		}, attribute.Int("index", int(i)))
 		if err != nil {
 			return nil, err
 		}
 
-		uuid, err := newDevice.UUID()
+		var uuid string
+		err = traceHLML(ctx, "UUID", func() (err error) {
+			uuid, err = newDevice.UUID()
+			return err
+		}, attribute.String("serial", serial))
 		if err != nil {
 			return nil, err
 		}
 
-		pciBusID, _ := newDevice.PCIBusID()
+		// The PCI bus ID is only logged, so failing to read it isn't fatal.
+		var pciBusID string
+		_ = traceHLML(ctx, "PCIBusID", func() (err error) {
+			pciBusID, err = newDevice.PCIBusID()
+			return err
+		}, attribute.String("serial", serial))
 
 		dID := fmt.Sprintf("%x", pciID)
 
@@ -90,7 +120,11 @@ func (dm *DeviceManager) Devices() ([]*pluginapi.Device, error) {
 			Health: pluginapi.Healthy,
 		}
 
-		cpuAffinity, err := newDevice.NumaNode()
+		var cpuAffinity *uint
+		err = traceHLML(ctx, "NumaNode", func() (err error) {
+			cpuAffinity, err = newDevice.NumaNode()
+			return err
+		}, attribute.String("serial", serial))
 		if err != nil {
 			return nil, err
 		}
@@ -116,31 +150,55 @@ func getDevice(devs []*pluginapi.Device, id string) *pluginapi.Device {
 	return nil
 }
 
-func watchXIDs(ctx context.Context, devs []*pluginapi.Device, xids chan<- *pluginapi.Device) {
+// watchXIDs reports devices hit by critical HLML events on xids. The check
+// interval and wait timeout are read from config on every check, so they
+// can change while watching. It returns once ctx is canceled, releasing the
+// HLML event set.
+func watchXIDs(ctx context.Context, log *slog.Logger, devs []*pluginapi.Device, xids chan<- deviceFailure, config func() *Config) {
 	eventSet := hlml.NewEventSet()
 	defer hlml.DeleteEventSet(eventSet)
 
 	for _, d := range devs {
-		err := hlml.RegisterEventForDevice(eventSet, int(hlml.HlmlCriticalError()), d.ID)
+		err := traceHLML(ctx, "RegisterEventForDevice", func() error {
+			return hlml.RegisterEventForDevice(eventSet, int(hlml.HlmlCriticalError()), d.ID)
+		}, attribute.String("serial", d.ID))
 		if err != nil {
-			slog.Error("Failed registering critical event for device. Marking it unhealthy", "device_id", d.ID, "error", err)
-			xids <- d
+			log.Error("Failed registering critical event for device. Marking it unhealthy", "device_id", d.ID, "error", err)
+			if !sendUnhealthy(ctx, xids, deviceFailure{d, fmt.Sprintf("Failed registering for critical error events: %v", err)}) {
+				return
+			}
 			continue
 		}
 	}
 
-	// TODO: provide as flag
-	healthCheckInterval := time.NewTicker(10 * time.Second)
+	interval := config().HealthCheckInterval
+	healthCheckInterval := time.NewTicker(interval)
+	defer healthCheckInterval.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-healthCheckInterval.C:
-			e, err := hlml.WaitForEvent(eventSet, 1000)
+			cfg := config()
+			if cfg.HealthCheckInterval != interval {
+				interval = cfg.HealthCheckInterval
+				healthCheckInterval.Reset(interval)
+				log.Info("Health check interval changed", "interval", interval)
+			}
+
+			var e *Event
+			err := traceHLML(ctx, "WaitForEvent", func() (err error) {
+				e, err = hlml.WaitForEvent(eventSet, int(cfg.EventWaitTimeout.Milliseconds()))
+				return err
+			})
 			if err != nil {
-				slog.Error("hlml WaitForEvent failed", "error", err.Error())
-				time.Sleep(2 * time.Second)
+				log.Error("hlml WaitForEvent failed", "error", err.Error())
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(2 * time.Second):
+				}
 				continue
 			}
 
@@ -148,32 +206,69 @@ func watchXIDs(ctx context.Context, devs []*pluginapi.Device, xids chan<- *plugi
 				continue
 			}
 
-			dev, err := hlml.DeviceHandleBySerial(e.Serial)
+			var dev *Device
+			err = traceHLML(ctx, "DeviceHandleBySerial", func() (err error) {
+				dev, err = hlml.DeviceHandleBySerial(e.Serial)
+				return err
+			}, attribute.String("serial", e.Serial))
 			if err != nil {
-				slog.Error("XidCriticalError: All devices will go unhealthy", "xid", e.Etype)
+				log.Error("XidCriticalError: All devices will go unhealthy", "xid", e.Etype)
 				// All devices are unhealthy
 				for _, d := range devs {
-					xids <- d
+					if !sendUnhealthy(ctx, xids, unidentifiedFailure(d, e)) {
+						return
+					}
 				}
 				continue
 			}
 
-			uuid, err := dev.UUID()
+			var uuid string
+			err = traceHLML(ctx, "UUID", func() (err error) {
+				uuid, err = dev.UUID()
+				return err
+			}, attribute.String("serial", e.Serial))
 			if err != nil || len(uuid) == 0 {
-				slog.Error("XidCriticalError: All devices will go unhealthy", "xid", e.Etype)
+				log.Error("XidCriticalError: All devices will go unhealthy", "xid", e.Etype)
 				// All devices are unhealthy
 				for _, d := range devs {
-					xids <- d
+					if !sendUnhealthy(ctx, xids, unidentifiedFailure(d, e)) {
+						return
+					}
 				}
 				continue
 			}
 
 			for _, d := range devs {
 				if d.ID == uuid {
-					slog.Error("XidCriticalError: the device will go unhealthy", "xid", e.Etype, "aip", d.ID)
-					xids <- d
+					log.Error("XidCriticalError: the device will go unhealthy", "xid", e.Etype, "aip", d.ID)
+					if !sendUnhealthy(ctx, xids, deviceFailure{d, fmt.Sprintf("Critical error xid %d reported by HLML", e.Etype)}) {
+						return
+					}
 				}
 			}
 		}
 	}
 }
+
+// deviceFailure is a device the health check found failing, and why.
+type deviceFailure struct {
+	dev    *pluginapi.Device
+	reason string
+}
+
+// unidentifiedFailure is the failure of d when HLML reports the critical
+// error e of a device it can't identify, which fails every device.
+func unidentifiedFailure(d *pluginapi.Device, e *Event) deviceFailure {
+	return deviceFailure{d, fmt.Sprintf("Critical error xid %d reported by HLML for unidentified device %q", e.Etype, e.Serial)}
+}
+
+// sendUnhealthy reports f on xids, unless ctx is canceled first. It
+// reports whether f was sent.
+func sendUnhealthy(ctx context.Context, xids chan<- deviceFailure, f deviceFailure) bool {
+	select {
+	case xids <- f:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -76,8 +75,6 @@ var (
 	ErrUnknownError       = errors.New("unknown error")
 )
 
-var pciBasePath = prefix + "/sys/bus/pci/devices"
-
 // Global variables holding the simulated devices
 var (
 	simulatedDevices         map[uint]*Device   // Access devices by index
@@ -97,6 +94,7 @@ func initializeSimulatedDevices(deviceCount uint) {
 			pciID:        0x1da31020,
 			pciBusID:     fmt.Sprintf("0000:00:1f.%d", i+1), // Create unique PCI Bus IDs based on index
 			numaNode:     int(i),                            // NUMA node assigned sequentially
+			Module:       i,                                 // Module IDs assigned sequentially
 		}
 
 		// Store in both maps
@@ -185,16 +183,14 @@ func (d *FakeHlml) Shutdown() error {
 func (d *FakeHlml) GetDeviceTypeName() (string, error) {
 	var deviceType string
 
-	fmt.Println("pciBasePath", pciBasePath)
-	fmt.Println("filepath", filepath.Join(pciBasePath))
-	fmt.Println("info")
+	hlmlLog.Debug("Scanning simulated PCI devices", "path", pciBasePath)
 	err := filepath.Walk(pciBasePath, func(path string, info os.FileInfo, err error) error {
-		log.Println(pciBasePath, info.Name())
 		if err != nil {
 			return fmt.Errorf("error accessing file path %q", path)
 		}
+		hlmlLog.Debug("Checking PCI device", "name", info.Name())
 		if info.IsDir() {
-			log.Println("Not a device, continuing")
+			hlmlLog.Debug("Not a device, continuing", "name", info.Name())
 			return nil
 		}
 		// Retrieve vendor for the device
@@ -280,6 +276,30 @@ func (d *FakeHlml) HlmlCriticalError() uint64 {
 	return 1 << 1 // fake value for HlmlCriticalError (same as #define HLML_EVENT_CRITICAL_ERR (1 << 1))
 }
 
+// SystemDriverVersion returns a simulated driver version
+func (d *FakeHlml) SystemDriverVersion() (string, error) {
+	return "1.16.0-fake", errorString(HLML_SUCCESS)
+}
+
+// FWVersion returns a simulated firmware version
+func (d *FakeHlml) FWVersion(index uint) (string, error) {
+	if _, found := simulatedDevices[index]; !found {
+		return "", errors.New("could not find device with index")
+	}
+	return "1.16.0-fw-fake", errorString(HLML_SUCCESS)
+}
+
+// Name returns a simulated device name
+func (d Device) Name() (string, error) {
+	return "HL-225", nil
+}
+
+// MemoryInfo returns simulated total, used and free memory in bytes
+func (d Device) MemoryInfo() (uint64, uint64, uint64, error) {
+	const total = 96 << 30
+	return total, 0, total, nil
+}
+
 // MinorNumber simulates returning the Minor number in the fake implementation
 func (d Device) MinorNumber() (uint, error) {
 	// Simulate returning a minor number (hardcoded or configurable in the fake struct)
@@ -68,3 +68,14 @@ func (r *RealHlml) DeviceHandleByIndex(index uint) (Device, error) {
 func (r *RealHlml) HlmlCriticalError() uint64 {
 	return realhlml.HlmlCriticalError
 }
+
+func (r *RealHlml) SystemDriverVersion() (string, error) {
+	return realhlml.SystemDriverVersion()
+}
+
+// FWVersion returns the firmware version of the device at index, as
+// reported by its kernel firmware.
+func (r *RealHlml) FWVersion(index uint) (string, error) {
+	kernel, _, err := realhlml.FWVersion(index)
+	return kernel, err
+}
@@ -14,4 +14,6 @@ type Hlml interface {
 	WaitForEvent(es *EventSet, timeout int) (*Event, error)
 	DeviceHandleByIndex(index uint) (Device, error)
 	HlmlCriticalError() uint64
+	SystemDriverVersion() (string, error)
+	FWVersion(index uint) (string, error)
 }
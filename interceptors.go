@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// correlationIDKey is the gRPC metadata key a caller may use to provide its
+// own correlation ID.
+const correlationIDKey = "x-correlation-id"
+
+type loggerCtxKey struct{}
+
+// loggerFromContext returns the request scoped logger stored by the
+// interceptors, or fallback when ctx does not carry one.
+func loggerFromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return fallback
+}
+
+// serverInterceptors returns the gRPC server options wiring request logging,
+// panic recovery and metrics into every unary and streaming call.
+func serverInterceptors(log *slog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryLoggingInterceptor(log), unaryRecoveryInterceptor(log)),
+		grpc.ChainStreamInterceptor(streamLoggingInterceptor(log), streamRecoveryInterceptor(log)),
+	}
+}
+
+func unaryLoggingInterceptor(log *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		reqLog := log.With("method", info.FullMethod, "correlation_id", correlationID(ctx))
+		ctx = context.WithValue(ctx, loggerCtxKey{}, reqLog)
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		observeRequest(reqLog, info.FullMethod, start, err, summarizeRequest(req)...)
+
+		return resp, err
+	}
+}
+
+func streamLoggingInterceptor(log *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		reqLog := log.With("method", info.FullMethod, "correlation_id", correlationID(ctx))
+		reqLog.Debug("gRPC stream opened")
+
+		start := time.Now()
+		err := handler(srv, &contextServerStream{
+			ServerStream: ss,
+			ctx:          context.WithValue(ctx, loggerCtxKey{}, reqLog),
+		})
+		observeRequest(reqLog, info.FullMethod, start, err)
+
+		return err
+	}
+}
+
+func unaryRecoveryInterceptor(log *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoverPanic(loggerFromContext(ctx, log), info.FullMethod, r)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func streamRecoveryInterceptor(log *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = recoverPanic(loggerFromContext(ss.Context(), log), info.FullMethod, r)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// recoverPanic logs a panic raised while serving method and converts it
+// into an Internal gRPC error, so a single bad request does not bring the
+// plugin down.
+func recoverPanic(log *slog.Logger, method string, r any) error {
+	grpcPanicsTotal.WithLabelValues(method).Inc()
+	log.Error("Recovered from panic in gRPC handler", "panic", r, "stack", string(debug.Stack()))
+	return status.Errorf(codes.Internal, "internal error while serving %s", method)
+}
+
+// observeRequest logs the outcome of a finished request and records it in
+// the gRPC metrics.
+func observeRequest(log *slog.Logger, method string, start time.Time, err error, attrs ...any) {
+	duration := time.Since(start)
+	code := status.Code(err)
+
+	grpcRequestsTotal.WithLabelValues(method, code.String()).Inc()
+	grpcRequestDuration.WithLabelValues(method).Observe(duration.Seconds())
+
+	attrs = append(attrs, "duration", duration, "code", code.String())
+	if err != nil {
+		log.Error("gRPC request failed", append(attrs, "error", err)...)
+		return
+	}
+	log.Info("gRPC request served", attrs...)
+}
+
+// summarizeRequest returns log attributes describing the kubelet request
+// without dumping the whole message.
+func summarizeRequest(req any) []any {
+	switch r := req.(type) {
+	case *pluginapi.AllocateRequest:
+		ids := make([][]string, 0, len(r.ContainerRequests))
+		for _, c := range r.ContainerRequests {
+			ids = append(ids, c.DevicesIds)
+		}
+		return []any{"containers", len(r.ContainerRequests), "device_ids", ids}
+	case *pluginapi.PreferredAllocationRequest:
+		return []any{"containers", len(r.ContainerRequests)}
+	case *pluginapi.PreStartContainerRequest:
+		return []any{"device_ids", r.DevicesIds}
+	}
+	return nil
+}
+
+// correlationID returns the caller supplied correlation ID or generates a
+// new one.
+func correlationID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(correlationIDKey); len(v) > 0 && v[0] != "" {
+			return v[0]
+		}
+	}
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextServerStream overrides the context of a grpc.ServerStream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// deviceInventory serves the devices of the node, their health and the
+// containers they are assigned to as JSON on the admin server. It is a
+// device observer.
+type deviceInventory struct {
+	pods *podResources
+
+	mu       sync.Mutex
+	features nodeFeatures
+	devs     []*pluginapi.Device
+}
+
+type inventoryDevice struct {
+	ID          string          `json:"id"`
+	Health      string          `json:"health"`
+	NUMANode    *int64          `json:"numaNode,omitempty"`
+	Allocatable *bool           `json:"allocatable,omitempty"`
+	AssignedTo  []podAssignment `json:"assignedTo,omitempty"`
+}
+
+func newDeviceInventory(pods *podResources) *deviceInventory {
+	return &deviceInventory{pods: pods}
+}
+
+// DevicesChanged records the devices served.
+func (i *deviceInventory) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	i.mu.Lock()
+	i.features, i.devs = features, devs
+	i.mu.Unlock()
+}
+
+func (i *deviceInventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	i.mu.Lock()
+	features, devs := i.features, i.devs
+	i.mu.Unlock()
+
+	devices := make([]inventoryDevice, 0, len(devs))
+	for _, d := range devs {
+		dev := inventoryDevice{ID: d.ID, Health: d.Health}
+		if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+			dev.NUMANode = &d.Topology.Nodes[0].ID
+		}
+		if allocatable, ok := i.pods.Allocatable(d.ID); ok {
+			dev.Allocatable = &allocatable
+		}
+		dev.AssignedTo = i.pods.Assignments(d.ID)
+		devices = append(devices, dev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = writeJSON(w, struct {
+		Family        string            `json:"family,omitempty"`
+		Model         string            `json:"model,omitempty"`
+		DriverVersion string            `json:"driverVersion,omitempty"`
+		Devices       []inventoryDevice `json:"devices"`
+	}{features.family, features.model, features.driver, devices})
+}
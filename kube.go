@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeRESTConfig returns the Kubernetes API client configuration from the
+// kubeconfig file, or the in-cluster configuration of the pod's service
+// account when it is empty.
+func kubeRESTConfig(kubeconfig string) (*rest.Config, error) {
+	var restConfig *rest.Config
+	var err error
+	if kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed loading Kubernetes client configuration: %w", err)
+	}
+	restConfig.UserAgent = "habanalabs-device-plugin/" + build
+	return restConfig, nil
+}
+
+// kubeClients creates the Kubernetes API clients of a command on first
+// use, sharing the client configuration of kubeRESTConfig.
+type kubeClients struct {
+	kubeconfig string
+	restConfig *rest.Config
+}
+
+func (c *kubeClients) config() (*rest.Config, error) {
+	if c.restConfig == nil {
+		restConfig, err := kubeRESTConfig(c.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		c.restConfig = restConfig
+	}
+	return c.restConfig, nil
+}
+
+// clientset returns a client of the built-in resources.
+func (c *kubeClients) clientset() (kubernetes.Interface, error) {
+	restConfig, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating Kubernetes client: %w", err)
+	}
+	return client, nil
+}
+
+// dynamicClient returns a client of custom resources.
+func (c *kubeClients) dynamicClient() (dynamic.Interface, error) {
+	restConfig, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating Kubernetes dynamic client: %w", err)
+	}
+	return client, nil
+}
+
+// latestUpdate hands the most recent of a stream of updates to the
+// goroutine applying them through the Kubernetes API. Updates superseded
+// before being applied are dropped, and failed ones are retried with
+// backoff unless superseded meanwhile.
+type latestUpdate[T any] struct {
+	mu      sync.Mutex
+	pending *T
+	wake    chan struct{}
+}
+
+func newLatestUpdate[T any]() *latestUpdate[T] {
+	return &latestUpdate[T]{wake: make(chan struct{}, 1)}
+}
+
+// Set schedules applying v, replacing the update still pending if any.
+func (u *latestUpdate[T]) Set(v T) {
+	u.mu.Lock()
+	u.pending = &v
+	u.mu.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run applies the updates with apply until ctx is done. Failures are
+// logged with msg.
+func (u *latestUpdate[T]) Run(ctx context.Context, log *slog.Logger, msg string, apply func(context.Context, T) error) {
+	retry := newBackoff(time.Second, time.Minute, 0)
+	var retryUpdate <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.wake:
+		case <-retryUpdate:
+		}
+		retryUpdate = nil
+
+		u.mu.Lock()
+		update := u.pending
+		u.pending = nil
+		u.mu.Unlock()
+		if update == nil {
+			continue
+		}
+
+		if err := apply(ctx, *update); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay, _ := retry.Next()
+			log.Warn(msg, "error", err, "attempt", retry.Attempts(), "retry_in", delay.Round(time.Millisecond))
+
+			u.mu.Lock()
+			if u.pending == nil {
+				u.pending = update
+			}
+			u.mu.Unlock()
+			retryUpdate = time.After(delay)
+			continue
+		}
+		retry.Reset()
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Reasons for registering with kubelet again.
+const (
+	reregisterKubeletSocket = "kubelet-socket-created"
+	reregisterKubeletChange = "kubelet-socket-replaced"
+	reregisterPluginSocket  = "plugin-socket-removed"
+)
+
+// kubeletMonitor detects kubelet restarts, which drop every device plugin
+// registration. Kubelet recreates its socket, possibly by renaming it into
+// place, and removes the plugin sockets of the device plugin directory when
+// it starts. Filesystem events catch these promptly; Check catches the ones
+// missed, e.g. while the watcher was overflowing.
+type kubeletMonitor struct {
+	log *slog.Logger
+
+	registered    bool
+	kubeletSocket string
+	pluginSocket  string
+	// kubelet is the kubelet socket the registration was made through.
+	kubelet os.FileInfo
+}
+
+func newKubeletMonitor(log *slog.Logger) *kubeletMonitor {
+	return &kubeletMonitor{log: log}
+}
+
+// Registered records a successful registration through kubeletSocket of
+// the plugin serving on pluginSocket.
+func (k *kubeletMonitor) Registered(kubeletSocket, pluginSocket string) {
+	k.registered = true
+	k.kubeletSocket, k.pluginSocket = kubeletSocket, pluginSocket
+	k.kubelet, _ = os.Stat(kubeletSocket)
+}
+
+// Reset forgets the registration when the plugin is stopped.
+func (k *kubeletMonitor) Reset() {
+	*k = kubeletMonitor{log: k.log}
+}
+
+// RestartReason returns why event requires registering with kubelet
+// again, or "" when it doesn't.
+func (k *kubeletMonitor) RestartReason(cfg *Config, event fsnotify.Event) string {
+	switch {
+	case event.Name == cfg.KubeletSocket() && event.Op&fsnotify.Create != 0:
+		// Also covers a socket renamed into place.
+		return reregisterKubeletSocket
+	case !k.registered:
+		return ""
+	case event.Name == k.kubeletSocket && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		k.log.Warn("Kubelet socket removed, waiting for kubelet to come back", "socket", event.Name)
+	case event.Name == k.pluginSocket && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// Stopping the plugin removes the socket too; the event is stale
+		// if the socket has been created again since.
+		if _, err := os.Stat(k.pluginSocket); os.IsNotExist(err) {
+			return reregisterPluginSocket
+		}
+	}
+	return ""
+}
+
+// Check verifies that the registration is still valid: the plugin socket
+// must exist and kubelet must still be serving on the socket the plugin
+// registered through. It returns why registering again is needed, or "".
+func (k *kubeletMonitor) Check() string {
+	if !k.registered {
+		return ""
+	}
+	if _, err := os.Stat(k.pluginSocket); os.IsNotExist(err) {
+		return reregisterPluginSocket
+	}
+	cur, err := os.Stat(k.kubeletSocket)
+	if err != nil {
+		// Kubelet is down; its socket being created will be noticed.
+		k.log.Debug("Kubelet socket unavailable", "socket", k.kubeletSocket, "error", err)
+		return ""
+	}
+	if k.kubelet == nil || !os.SameFile(k.kubelet, cur) {
+		return reregisterKubeletChange
+	}
+	return ""
+}
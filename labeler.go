@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodeHealthAnnotation is the annotation, under the resource prefix,
+// holding the health of every device by serial number.
+const nodeHealthAnnotation = "device-health"
+
+// nodeLabelGroups are the label names, under the resource prefix, owned by
+// the labeler. Labels in them that are no longer reported are removed.
+var nodeLabelGroups = []string{"device.", "driver.", "firmware.", "numa."}
+
+// nodeLabeler keeps labels and an annotation describing the node's devices
+// on the plugin's own Node object. Updates are patched in the background by
+// Run.
+type nodeLabeler struct {
+	log      *slog.Logger
+	client   kubernetes.Interface
+	nodeName string
+	prefix   string
+	updates  *latestUpdate[nodeMetadata]
+
+	// applied holds the label keys set by the last successful patch. It is
+	// nil until the labels of the Node have been read.
+	applied map[string]bool
+}
+
+// nodeMetadata is an update of the labels and annotations of the Node.
+type nodeMetadata struct {
+	labels      map[string]string
+	annotations map[string]string
+}
+
+func newNodeLabeler(log *slog.Logger, client kubernetes.Interface, nodeName, prefix string) *nodeLabeler {
+	return &nodeLabeler{
+		log:      log,
+		client:   client,
+		nodeName: nodeName,
+		prefix:   prefix,
+		updates:  newLatestUpdate[nodeMetadata](),
+	}
+}
+
+// DevicesChanged schedules updating the Node with features and devs.
+func (l *nodeLabeler) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	health := make(map[string]string, len(devs))
+	for _, d := range devs {
+		health[d.ID] = d.Health
+	}
+	summary, _ := json.Marshal(health) // a map of strings always marshals
+
+	l.updates.Set(nodeMetadata{
+		labels:      features.labels(l.prefix, devs),
+		annotations: map[string]string{l.prefix + nodeHealthAnnotation: string(summary)},
+	})
+}
+
+// Run patches the Node with the pending updates until ctx is done.
+func (l *nodeLabeler) Run(ctx context.Context) {
+	l.updates.Run(ctx, l.log.With("node", l.nodeName), "Failed labeling node, retrying", l.patch)
+}
+
+// patch applies update to the Node, removing the labels the labeler set
+// before that update no longer has.
+func (l *nodeLabeler) patch(ctx context.Context, update nodeMetadata) error {
+	if l.applied == nil {
+		node, err := l.client.CoreV1().Nodes().Get(ctx, l.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed getting node: %w", err)
+		}
+		l.applied = make(map[string]bool)
+		for k := range node.Labels {
+			if l.owns(k) {
+				l.applied[k] = true
+			}
+		}
+	}
+
+	labels := make(map[string]*string, len(update.labels)+len(l.applied))
+	for k := range l.applied {
+		if _, ok := update.labels[k]; !ok {
+			labels[k] = nil
+		}
+	}
+	for k, v := range update.labels {
+		labels[k] = &v
+	}
+
+	var p struct {
+		Metadata struct {
+			Labels      map[string]*string `json:"labels"`
+			Annotations map[string]string  `json:"annotations"`
+		} `json:"metadata"`
+	}
+	p.Metadata.Labels = labels
+	p.Metadata.Annotations = update.annotations
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.CoreV1().Nodes().Patch(ctx, l.nodeName, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed patching node: %w", err)
+	}
+
+	l.applied = make(map[string]bool, len(update.labels))
+	for k := range update.labels {
+		l.applied[k] = true
+	}
+	l.log.Debug("Updated node labels", "node", l.nodeName, "labels", len(update.labels))
+	return nil
+}
+
+// owns reports whether the label key is one the labeler manages.
+func (l *nodeLabeler) owns(key string) bool {
+	name, ok := strings.CutPrefix(key, l.prefix)
+	if !ok {
+		return false
+	}
+	for _, g := range nodeLabelGroups {
+		if strings.HasPrefix(name, g) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// numaDevice returns a device on the NUMA node numa.
+func numaDevice(id, health string, numa int64) *pluginapi.Device {
+	return &pluginapi.Device{ID: id, Health: health, Topology: &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: numa}}}}
+}
+
+// waitNode waits for the Node name of client to satisfy ok and returns it.
+func waitNode(t *testing.T, client *fake.Clientset, name string, ok func(*corev1.Node) bool) *corev1.Node {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok(node) {
+			return node
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node labels %v, annotations %v", node.Labels, node.Annotations)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeLabeler(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node-1",
+		Labels: map[string]string{
+			"kubernetes.io/hostname":        "node-1",
+			"habana.ai/numa.node-3.devices": "2",
+			"habana.ai/custom":              "kept",
+		},
+		Annotations: map[string]string{"example.com/note": "kept"},
+	}})
+	l := newNodeLabeler(logs.Logger(), client, "node-1", "habana.ai/")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+
+	features := nodeFeatures{family: "gaudi2", model: "HL-225", driver: "1.17.0"}
+	l.DevicesChanged(features, []*pluginapi.Device{
+		numaDevice("A", pluginapi.Healthy, 0),
+		numaDevice("B", pluginapi.Healthy, 0),
+		numaDevice("C", pluginapi.Unhealthy, 1),
+	})
+	want := map[string]string{
+		"kubernetes.io/hostname":        "node-1",
+		"habana.ai/custom":              "kept",
+		"habana.ai/device.family":       "gaudi2",
+		"habana.ai/device.model":        "HL-225",
+		"habana.ai/device.count":        "3",
+		"habana.ai/device.healthy":      "2",
+		"habana.ai/driver.version":      "1.17.0",
+		"habana.ai/numa.nodes":          "2",
+		"habana.ai/numa.node-0.devices": "2",
+		"habana.ai/numa.node-1.devices": "1",
+	}
+	node := waitNode(t, client, "node-1", func(n *corev1.Node) bool { return maps.Equal(n.Labels, want) })
+	var health map[string]string
+	if err := json.Unmarshal([]byte(node.Annotations["habana.ai/device-health"]), &health); err != nil {
+		t.Fatalf("device-health annotation: %v", err)
+	}
+	if health["C"] != pluginapi.Unhealthy || health["A"] != pluginapi.Healthy || len(health) != 3 {
+		t.Errorf("device-health = %v", health)
+	}
+	if node.Annotations["example.com/note"] != "kept" {
+		t.Errorf("annotations = %v, want the others kept", node.Annotations)
+	}
+
+	// The devices of NUMA node 1 are gone.
+	l.DevicesChanged(features, []*pluginapi.Device{numaDevice("A", pluginapi.Healthy, 0)})
+	delete(want, "habana.ai/numa.node-1.devices")
+	want["habana.ai/device.count"], want["habana.ai/device.healthy"], want["habana.ai/numa.nodes"] = "1", "1", "1"
+	want["habana.ai/numa.node-0.devices"] = "1"
+	waitNode(t, client, "node-1", func(n *corev1.Node) bool { return maps.Equal(n.Labels, want) })
+
+	var patches []k8stesting.PatchAction
+	for _, a := range client.Actions() {
+		if p, ok := a.(k8stesting.PatchAction); ok {
+			patches = append(patches, p)
+		}
+	}
+	if len(patches) != 2 {
+		t.Fatalf("node patched %d times, want 2", len(patches))
+	}
+	for _, p := range patches {
+		if p.GetPatchType() != types.MergePatchType {
+			t.Errorf("patch type = %s, want a merge patch", p.GetPatchType())
+		}
+	}
+	var last struct {
+		Metadata struct {
+			Labels map[string]*string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(patches[1].GetPatch(), &last); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := last.Metadata.Labels["habana.ai/numa.node-1.devices"]; !ok || v != nil {
+		t.Errorf("last patch %s doesn't remove the stale label", patches[1].GetPatch())
+	}
+	if _, ok := last.Metadata.Labels["habana.ai/custom"]; ok {
+		t.Errorf("last patch %s touches a label the labeler doesn't own", patches[1].GetPatch())
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Subsystems with their own logger and level.
+const (
+	subsystemDiscovery = "discovery"
+	subsystemHealth    = "health"
+	subsystemGRPC      = "grpc"
+	subsystemHLML      = "hlml"
+)
+
+var subsystems = []string{subsystemDiscovery, subsystemHealth, subsystemGRPC, subsystemHLML}
+
+// Supported log output formats.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// hlmlLog is the logger of the HLML subsystem. HLML is reached through the
+// global hlml variable, so its logger lives next to it.
+var hlmlLog = slog.New(slog.DiscardHandler)
+
+// logging owns the root logger and the levels of every subsystem logger.
+// Levels are slog.LevelVars so they can be changed while the plugin runs.
+type logging struct {
+	mu       sync.Mutex
+	base     slog.Handler
+	root     *slog.LevelVar
+	levels   map[string]*slog.LevelVar
+	defaults map[string]slog.Level
+	debug    bool
+}
+
+// newLogging creates the loggers writing to w in the given format, with
+// every subsystem starting at level.
+func newLogging(w io.Writer, format string, level slog.Level) (*logging, error) {
+	// Filtering is done by leveledHandler, so the base handler lets
+	// everything through.
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var h slog.Handler
+	switch format {
+	case logFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	case logFormatText:
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, expected %q or %q", format, logFormatJSON, logFormatText)
+	}
+
+	l := &logging{
+		base:     h.WithAttrs([]slog.Attr{slog.String("service", "habana-device-plugin")}),
+		root:     new(slog.LevelVar),
+		levels:   make(map[string]*slog.LevelVar, len(subsystems)),
+		defaults: make(map[string]slog.Level, len(subsystems)+1),
+	}
+	l.root.Set(level)
+	l.defaults[""] = level
+	for _, s := range subsystems {
+		lv := new(slog.LevelVar)
+		lv.Set(level)
+		l.levels[s] = lv
+		l.defaults[s] = level
+	}
+
+	return l, nil
+}
+
+// Logger returns the root logger.
+func (l *logging) Logger() *slog.Logger {
+	return slog.New(&leveledHandler{Handler: l.base, level: l.root})
+}
+
+// For returns the logger of subsystem. Records carry a "subsystem"
+// attribute and are filtered by the subsystem's own level.
+func (l *logging) For(subsystem string) *slog.Logger {
+	lv, ok := l.levels[subsystem]
+	if !ok {
+		lv = l.root
+	}
+	h := l.base.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)})
+	return slog.New(&leveledHandler{Handler: h, level: lv})
+}
+
+// SetLevel changes the level of subsystem, or of the root logger and every
+// subsystem when subsystem is empty. The new level becomes the one restored
+// when debug logging is toggled off.
+func (l *logging) SetLevel(subsystem string, level slog.Level) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if subsystem == "" {
+		l.debug = false
+		l.root.Set(level)
+		l.defaults[""] = level
+		for s, lv := range l.levels {
+			lv.Set(level)
+			l.defaults[s] = level
+		}
+		return nil
+	}
+
+	lv, ok := l.levels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem %q, expected one of %s", subsystem, strings.Join(subsystems, ", "))
+	}
+	lv.Set(level)
+	l.defaults[subsystem] = level
+	return nil
+}
+
+// Levels returns the current level of the root logger and of every
+// subsystem.
+func (l *logging) Levels() map[string]string {
+	levels := map[string]string{"root": l.root.Level().String()}
+	for s, lv := range l.levels {
+		levels[s] = lv.Level().String()
+	}
+	return levels
+}
+
+// ToggleDebug switches every logger to debug, or back to the levels that
+// were set before. It returns whether debug logging is now enabled.
+func (l *logging) ToggleDebug() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.debug = !l.debug
+	if l.debug {
+		l.root.Set(slog.LevelDebug)
+		for _, lv := range l.levels {
+			lv.Set(slog.LevelDebug)
+		}
+		return true
+	}
+
+	l.root.Set(l.defaults[""])
+	for s, lv := range l.levels {
+		lv.Set(l.defaults[s])
+	}
+	return false
+}
+
+// ServeHTTP implements the admin API for log levels. GET returns the current
+// levels; PUT or POST with ?level=<level>[&subsystem=<name>] changes them.
+func (l *logging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := l.SetLevel(r.URL.Query().Get("subsystem"), level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(l.Levels())
+}
+
+// leveledHandler filters records below a dynamic level before handing them
+// to the wrapped handler.
+type leveledHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
@@ -17,126 +17,352 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
 	"syscall"
-
-	"github.com/fsnotify/fsnotify"
-
-	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"time"
 )
 
 // Define a global variable
 var hlml Hlml
 
-var prefix = "/home/hsyrja/works/repos/habanalabs-k8s-device-plugin/tmp"
+// pciBasePath is the sysfs directory of PCI devices as seen from inside the
+// plugin, set from the configuration.
+var pciBasePath string
 
 // build is overridden with an actual version in the build process.
 var build = "develop"
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// setup initializes the globals shared by every command from cfg and
+// returns the loggers, writing to w.
+func setup(cfg *Config, w io.Writer) (*logging, error) {
+	pciBasePath = cfg.HostPath(cfg.PCIDevicesPath)
+
 	// Initialize the global variable
 	hlml = getHlml()
 
-	log := initLogger()
-	if err := run(log); err != nil {
-		log.Error(err.Error())
-		os.Exit(1)
+	logs, err := initLogger(w, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		return nil, err
 	}
+	hlmlLog = logs.For(subsystemHLML)
+
+	return logs, nil
 }
 
-func initLogger() *slog.Logger {
-	lvl := slog.LevelInfo
-	if os.Getenv("LOG_LEVEL") == slog.LevelDebug.String() {
-		lvl = slog.LevelDebug
+func initLogger(w io.Writer, format, level string) (*logging, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
 	}
-	attrs := []slog.Attr{
-		slog.String("service", "habana-device-plugin"),
+	return newLogging(w, format, lvl)
+}
+
+// countDevices returns the number of devices HLML sees. HLML enumerates
+// devices when it is initialized, so it is initialized again first when
+// refresh is set, to find devices of a driver loaded since.
+func countDevices(refresh bool) (uint, error) {
+	if refresh {
+		if err := hlml.Shutdown(); err != nil {
+			hlmlLog.Debug("Failed shutting down HLML before refreshing devices", "error", err)
+		}
+		if err := hlml.Initialize(); err != nil {
+			hlmlLog.Debug("Failed initializing HLML, no devices yet", "error", err)
+			return 0, nil
+		}
 	}
-	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: lvl}).WithAttrs(attrs)
-	return slog.New(h)
+	return hlml.DeviceCount()
 }
 
-func run(log *slog.Logger) error {
+// run serves the device plugin until a termination signal is received. load
+// resolves the configuration again when the configuration file changes or
+// SIGHUP is received.
+func run(log *slog.Logger, logs *logging, cfg *Config, load func() (*Config, error)) error {
 	restart := true
-	log.Info("Started Habana device plugin manager", "version", build)
+	log.Info("Started Habana device plugin manager", "version", build, "config_file", cfg.ConfigFile, "host_root", cfg.HostRoot)
+
+	// ctx bounds every goroutine started on behalf of the plugin.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdownTracing, err := initTracing(context.Background(), log, cfg.TracingEndpoint)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error("Failed flushing traces", "error", err)
+		}
+	}()
 
-	log.Info("Initializing HLML...")
+	// reports are told about the devices served, or their absence.
+	reports, err := startReporting(ctx, log, logs, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		reports.Stop()
+	}()
+
+	ready := newReadiness()
+	if cfg.AdminAddr != "" {
+		adminServer := newAdminServer(log, cfg.AdminAddr, logs, ready, reports.inventory)
+		startAdminServer(log, adminServer)
+		defer adminServer.Close()
+	}
+
+	hlmlLog.Info("Initializing HLML...")
+	// HLML fails to initialize until the driver is loaded; that is treated
+	// like a node without devices.
+	refreshHLML := false
 	if err := hlml.Initialize(); err != nil {
-		return fmt.Errorf("failed to initialize HLML: %w", err)
+		hlmlLog.Warn("Failed to initialize HLML, is the driver loaded?", "error", err)
+		refreshHLML = true
 	}
 	defer func() {
-		log.Info("Shutting down hlml")
+		hlmlLog.Info("Shutting down hlml")
 		err := hlml.Shutdown()
 		if err != nil {
-			log.Error(err.Error())
+			hlmlLog.Error(err.Error())
 		}
 	}()
 
 	log.Info("Starting FS watcher...")
-	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
+	watcher, err := newFSWatcher(cfg.DevicePluginPath)
 	if err != nil {
 		return fmt.Errorf("failed to create FS watcher: %w", err)
 	}
 	defer watcher.Close()
 
+	if err := watchConfig(watcher, cfg); err != nil {
+		return fmt.Errorf("failed watching config file: %w", err)
+	}
+
 	log.Info("Starting OS watcher...")
-	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1)
 
-	dev, err := hlml.GetDeviceTypeName()
-	if err != nil {
-		return fmt.Errorf("failed detecting Habana's devices on the system: %w", err)
+	// The device type, and with it the device plugin, is only known once
+	// devices are present.
+	var dev string
+	var devicePlugin *HabanalabsDevicePlugin
+	defer func() {
+		// Stopping waits for the plugin's goroutines, whatever run returns.
+		if devicePlugin != nil {
+			_ = devicePlugin.Stop()
+		}
+	}()
+	// newDevicePlugin returns a device plugin for dev, serving the devices
+	// of unhealthy as unhealthy.
+	newDevicePlugin := func(cfg *Config, unhealthy []string) *HabanalabsDevicePlugin {
+		plugin := NewHabanalabsDevicePlugin(
+			logs,
+			NewDeviceManager(logs.For(subsystemDiscovery), strings.ToUpper(dev)),
+			cfg.ResourceName(dev),
+			cfg.PluginSocket(dev),
+			cfg.RegistrationSocket(dev),
+			cfg,
+		)
+		plugin.Observe(reports)
+		plugin.UsePodResources(reports.pods)
+		plugin.CarryUnhealthy(unhealthy...)
+		return plugin
+	}
+
+	waiter := newDeviceWaiter(logs.For(subsystemDiscovery), watcher)
+	var checkDevices <-chan time.Time
+
+	// Registration is retried with backoff while the process stays up;
+	// retryRegistration fires when the next attempt is due.
+	retry := newBackoff(cfg.RegistrationBackoff, cfg.RegistrationMaxBackoff, cfg.RegistrationDeadline)
+	var retryRegistration <-chan time.Time
+
+	kubelet := newKubeletMonitor(log)
+	var checkRegistration <-chan time.Time
+	// pluginDone is closed when the registered plugin stops serving on its
+	// own, which is fatal.
+	var pluginDone <-chan struct{}
+	// registrations delivers kubelet's registration verdicts in
+	// pluginwatcher mode.
+	var registrations <-chan registrationStatus
+
+	reload := func() {
+		prev := cfg
+		var restartPlugin bool
+		cfg, restartPlugin = reloadConfig(log, logs, devicePlugin, reports, cfg, load)
+		retry = reloadRegistrationBackoff(retry, prev, cfg)
+		if !restartPlugin {
+			return
+		}
+
+		if cfg.DevicePluginPath != prev.DevicePluginPath {
+			_ = watcher.Remove(prev.DevicePluginPath)
+			if err := watcher.Add(cfg.DevicePluginPath); err != nil {
+				log.Error("Failed watching device plugin directory", "path", cfg.DevicePluginPath, "error", err)
+			}
+		}
+		if devicePlugin == nil {
+			return
+		}
+
+		log.Warn("Resource name, socket or registration mode changed, restarting device plugin.",
+			"resource_name", cfg.ResourceName(dev), "socket", cfg.PluginSocket(dev))
+		if err := devicePlugin.Stop(); err != nil {
+			log.Warn("Failed stopping device plugin gracefully", "error", err)
+		}
+		devicePlugin = newDevicePlugin(cfg, devicePlugin.Unhealthy())
+		restart = true
 	}
 
-	devicePlugin := NewHabanalabsDevicePlugin(
-		log,
-		NewDeviceManager(log, strings.ToUpper(dev)),
-		"habana.ai/"+dev,
-		pluginapi.DevicePluginPath+dev+"_habanalabs.sock",
-	)
+	// startPlugin registers the device plugin once devices are present,
+	// scheduling a retry when kubelet can't be reached.
+	startPlugin := func() error {
+		waiter.Found()
+
+		if devicePlugin == nil {
+			var err error
+			if dev, err = hlml.GetDeviceTypeName(); err != nil {
+				return fmt.Errorf("failed detecting Habana's devices on the system: %w", err)
+			}
+			devicePlugin = newDevicePlugin(cfg, reports.unhealthy)
+		}
+
+		ready.Set(stateRegistering, "registering with kubelet")
+		if err := devicePlugin.Serve(ctx); err != nil {
+			registrationAttemptsTotal.WithLabelValues("failure").Inc()
+			delay, ok := retry.Next()
+			if !ok {
+				return fmt.Errorf("could not register with kubelet for %s, giving up. Did you enable the device plugin feature gate?: %w", retry.Elapsed().Round(time.Second), err)
+			}
+			log.Warn("Could not contact kubelet, retrying",
+				"error", err, "attempt", retry.Attempts(), "retry_in", delay.Round(time.Millisecond))
+			ready.Set(stateRegistering, fmt.Sprintf("attempt %d failed: %v", retry.Attempts(), err))
+			retryRegistration = time.After(delay)
+			return nil
+		}
+		kubelet.Registered(cfg.KubeletSocket(), devicePlugin.socket)
+		pluginDone = devicePlugin.Done()
+		checkRegistration = time.After(cfg.RegistrationCheckInterval)
+		if cfg.RegistrationMode == registrationModePluginWatcher {
+			registrations = devicePlugin.RegistrationStatus()
+			ready.Set(stateRegistering, "waiting for kubelet to discover the plugin")
+			return nil
+		}
+
+		registrationAttemptsTotal.WithLabelValues("success").Inc()
+		if n := retry.Attempts(); n > 0 {
+			log.Info("Registered with kubelet after retrying", "failed_attempts", n)
+		}
+		retry.Reset()
+		ready.Set(stateRegistered, "")
+		return nil
+	}
 
 L:
 	for {
 		if restart {
-			err = devicePlugin.Stop()
-			if err != nil {
-				log.Warn("Failed stopping device plugin gracefully", "error", err)
+			restart = false
+			retryRegistration = nil
+			checkDevices = nil
+			checkRegistration = nil
+			pluginDone = nil
+			registrations = nil
+			kubelet.Reset()
+
+			if devicePlugin != nil {
+				if err := devicePlugin.Stop(); err != nil {
+					log.Warn("Failed stopping device plugin gracefully", "error", err)
+				}
 			}
 
-			numDevices, err := hlml.DeviceCount()
+			numDevices, err := countDevices(refreshHLML || waiter.Waiting())
 			if err != nil {
 				return fmt.Errorf("failed getting number of devices: %w", err)
 			}
+			refreshHLML = false
 
 			if numDevices == 0 {
-				continue
-			}
-
-			if err := devicePlugin.Serve(); err != nil {
-				log.Error(err.Error())
-				return fmt.Errorf("could not contact Kubelet, retrying. Did you enable the device plugin feature gate?")
+				if err := removeNodeFeatures(cfg.NFDFeaturesPath); err != nil {
+					log.Warn("Failed removing device features", "error", err)
+				}
+				reports.DevicesChanged(nodeFeatures{}, nil)
+				ready.Set(stateWaitingForDevices, "no Habana devices found")
+				checkDevices = waiter.Wait(cfg)
+			} else if err := startPlugin(); err != nil {
+				return err
 			}
-			restart = false
 		}
 
 		select {
+		case <-retryRegistration:
+			restart = true
+		case <-checkDevices:
+			restart = true
+		case s := <-registrations:
+			if s.registered {
+				log.Info("Kubelet registered the device plugin")
+				registrationAttemptsTotal.WithLabelValues("success").Inc()
+				ready.Set(stateRegistered, "")
+			} else {
+				log.Error("Kubelet failed registering the device plugin", "error", s.err)
+				registrationAttemptsTotal.WithLabelValues("failure").Inc()
+				ready.Set(stateRegistering, "kubelet failed registering the plugin: "+s.err)
+			}
+		case <-pluginDone:
+			ready.Set(stateStopping, "device plugin failed")
+			return fmt.Errorf("device plugin stopped serving: %w", devicePlugin.Stop())
+		case <-checkRegistration:
+			if reason := kubelet.Check(); reason != "" {
+				log.Warn("Registration with kubelet lost, restarting device plugin.", "reason", reason)
+				reregistrationsTotal.WithLabelValues(reason).Inc()
+				restart = true
+			} else {
+				checkRegistration = time.After(cfg.RegistrationCheckInterval)
+			}
 		case event := <-watcher.Events:
-			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Warn("Kubelet restart detected, restarting device plugin.")
+			reason := kubelet.RestartReason(cfg, event)
+			switch {
+			case reason != "":
+				log.Warn("Kubelet restart detected, restarting device plugin.", "reason", reason)
+				if ready.State() == stateRegistered {
+					reregistrationsTotal.WithLabelValues(reason).Inc()
+				}
 				restart = true
+			case isConfigEvent(cfg, event):
+				log.Info("Config file changed, reloading.", "event", event)
+				reload()
+			case waiter.Waiting() && waiter.IsDeviceEvent(event):
+				// Let the burst of events of a loading driver settle.
+				checkDevices = time.After(deviceEventSettle)
 			}
 		case err := <-watcher.Errors:
 			log.Error("Watcher error received", "error", err)
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
-				log.Info("Received SIGHUP, restarting.")
-				restart = true
+				log.Info("Received SIGHUP, reloading configuration.")
+				reload()
+			case syscall.SIGUSR1:
+				debug := logs.ToggleDebug()
+				log.Warn("Received SIGUSR1, toggled debug logging", "debug", debug)
 			default:
 				log.Info("Received OS signal. Shutting down", "signal", s)
-				if err := devicePlugin.Stop(); err != nil {
+				ready.Set(stateStopping, "received "+s.String())
+				if devicePlugin == nil {
+					break L
+				}
+				shutdownCtx, cancel := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+				err := devicePlugin.Shutdown(shutdownCtx)
+				cancel()
+				if err != nil {
 					log.Error("Failed stopping device plugin gracefully", "error", err)
 				}
 				break L
@@ -145,3 +371,15 @@ L:
 	}
 	return nil
 }
+
+// reloadRegistrationBackoff returns the registration backoff to use once
+// the configuration changed from prev to cfg. A new backoff would forget
+// the failed attempts, and with them the deadline, so retry is only
+// replaced when its settings change.
+func reloadRegistrationBackoff(retry *backoff, prev, cfg *Config) *backoff {
+	if cfg.RegistrationBackoff == prev.RegistrationBackoff && cfg.RegistrationMaxBackoff == prev.RegistrationMaxBackoff &&
+		cfg.RegistrationDeadline == prev.RegistrationDeadline {
+		return retry
+	}
+	return newBackoff(cfg.RegistrationBackoff, cfg.RegistrationMaxBackoff, cfg.RegistrationDeadline)
+}
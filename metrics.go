@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "habana_device_plugin"
+
+// metricsRegistry holds every metric exposed by the plugin. A dedicated
+// registry keeps the output free of metrics registered by dependencies.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Number of gRPC requests served, by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of gRPC requests, by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"method"})
+
+	grpcPanicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "grpc",
+		Name:      "panics_recovered_total",
+		Help:      "Number of panics recovered while serving gRPC requests, by method.",
+	}, []string{"method"})
+)
+
+var (
+	registeredGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "registered",
+		Help:      "Whether the device plugin is currently registered with kubelet.",
+	})
+
+	registrationAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "registration_attempts_total",
+		Help:      "Number of attempts to register with kubelet, by result.",
+	}, []string{"result"})
+
+	reregistrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reregistrations_total",
+		Help:      "Number of times the plugin registered with kubelet again after a kubelet restart, by how the restart was detected.",
+	}, []string{"reason"})
+)
+
+var deviceAssignedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "device_assigned",
+	Help:      "Containers the devices are assigned to, as reported by kubelet; always 1.",
+}, []string{"device", "namespace", "pod", "container"})
+
+var (
+	fleetDevicesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fleet",
+		Name:      "devices",
+		Help:      "Habana devices of the cluster, by health, as aggregated by the health controller.",
+	}, []string{"health"})
+
+	fleetDevicesInUseGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fleet",
+		Name:      "devices_in_use",
+		Help:      "Habana devices of the cluster used by pods, as aggregated by the health controller.",
+	})
+
+	fleetUnhealthyDevicesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fleet",
+		Name:      "unhealthy_devices",
+		Help:      "Habana devices not healthy, by node, as aggregated by the health controller.",
+	}, []string{"node"})
+)
+
+// updateAssignmentMetrics replaces the device assignments exported.
+func updateAssignmentMetrics(assignments map[string][]podAssignment) {
+	deviceAssignedGauge.Reset()
+	for id, as := range assignments {
+		for _, a := range as {
+			deviceAssignedGauge.WithLabelValues(id, a.Namespace, a.Pod, a.Container).Set(1)
+		}
+	}
+}
+
+// updateFleetMetrics replaces the fleet status exported.
+func updateFleetMetrics(s fleetSummary) {
+	fleetDevicesGauge.Reset()
+	for health, n := range s.Health {
+		fleetDevicesGauge.WithLabelValues(health).Set(float64(n))
+	}
+	fleetDevicesInUseGauge.Set(float64(s.InUse))
+	fleetUnhealthyDevicesGauge.Reset()
+	for node, n := range s.UnhealthyNodes {
+		fleetUnhealthyDevicesGauge.WithLabelValues(node).Set(float64(n))
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		grpcRequestsTotal,
+		grpcRequestDuration,
+		grpcPanicsTotal,
+		registeredGauge,
+		registrationAttemptsTotal,
+		reregistrationsTotal,
+		deviceAssignedGauge,
+		fleetDevicesGauge,
+		fleetDevicesInUseGauge,
+		fleetUnhealthyDevicesGauge,
+	)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	// modulesAnnotation, under the resource prefix, lists the module IDs
+	// of the node's devices.
+	modulesAnnotation = "modules"
+	// freeModulesAnnotation, under the resource prefix, lists the module
+	// IDs of the healthy devices not assigned to containers.
+	freeModulesAnnotation = "free-modules"
+)
+
+// formatModules formats module IDs as a sorted comma-separated list.
+func formatModules(ids []int) string {
+	ids = slices.Sorted(slices.Values(ids))
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// parseModules parses a comma-separated list of module IDs.
+func parseModules(s string) ([]int, error) {
+	var ids []int
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.Atoi(f)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid module ID %q", f)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// moduleAnnotations are the module annotations of the Node, formatted.
+// Both are empty without devices.
+type moduleAnnotations struct {
+	modules, free string
+}
+
+// moduleAnnotator keeps annotations listing the module IDs of the node's
+// devices, and those of them that are free, on the plugin's own Node for
+// the scheduler extender. As assignments change without the devices
+// changing, the annotations are refreshed every interval too. Updates are
+// patched in the background by Run.
+type moduleAnnotator struct {
+	log      *slog.Logger
+	client   kubernetes.Interface
+	nodeName string
+	prefix   string
+	pods     *podResources
+	interval time.Duration
+	updates  *latestUpdate[moduleAnnotations]
+
+	mu        sync.Mutex
+	moduleIDs map[string]uint
+	devs      []*pluginapi.Device
+	// last holds the annotations last handed to updates.
+	last *moduleAnnotations
+}
+
+func newModuleAnnotator(log *slog.Logger, client kubernetes.Interface, nodeName, prefix string, pods *podResources, interval time.Duration) *moduleAnnotator {
+	return &moduleAnnotator{
+		log:      log,
+		client:   client,
+		nodeName: nodeName,
+		prefix:   prefix,
+		pods:     pods,
+		interval: interval,
+		updates:  newLatestUpdate[moduleAnnotations](),
+	}
+}
+
+// DevicesChanged schedules annotating the Node with the modules of devs.
+func (a *moduleAnnotator) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	a.mu.Lock()
+	a.moduleIDs, a.devs = features.moduleIDs, devs
+	a.mu.Unlock()
+	a.refresh()
+}
+
+// Run patches the annotations until ctx is done.
+func (a *moduleAnnotator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Go(func() {
+		a.updates.Run(ctx, a.log.With("node", a.nodeName), "Failed annotating node with device modules, retrying", a.apply)
+	})
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.refresh()
+		}
+	}
+}
+
+// refresh schedules patching the annotations when they changed.
+func (a *moduleAnnotator) refresh() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var modules, free []int
+	for _, d := range a.devs {
+		id, ok := a.moduleIDs[d.ID]
+		if !ok {
+			continue
+		}
+		modules = append(modules, int(id))
+		if allocatable, ok := a.pods.Allocatable(d.ID); d.Health != pluginapi.Healthy || (ok && !allocatable) {
+			continue
+		}
+		if len(a.pods.Assignments(d.ID)) == 0 {
+			free = append(free, int(id))
+		}
+	}
+	m := moduleAnnotations{modules: formatModules(modules), free: formatModules(free)}
+
+	if a.last != nil && *a.last == m {
+		return
+	}
+	a.last = &m
+	a.updates.Set(m)
+}
+
+// apply patches the annotations of the Node, removing them when the node
+// has no devices.
+func (a *moduleAnnotator) apply(ctx context.Context, m moduleAnnotations) error {
+	annotations := map[string]any{a.prefix + modulesAnnotation: nil, a.prefix + freeModulesAnnotation: nil}
+	if m.modules != "" {
+		annotations[a.prefix+modulesAnnotation] = m.modules
+		annotations[a.prefix+freeModulesAnnotation] = m.free
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	if _, err := a.client.CoreV1().Nodes().Patch(ctx, a.nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed patching node: %w", err)
+	}
+	a.log.Debug("Annotated node with device modules", "node", a.nodeName, "modules", m.modules, "free", m.free)
+	return nil
+}
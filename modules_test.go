@@ -0,0 +1,130 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+func TestModuleAnnotator(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaudi := func(ids ...string) []*podresourcesapi.ContainerDevices {
+		return []*podresourcesapi.ContainerDevices{{ResourceName: "habana.ai/gaudi", DeviceIds: ids}}
+	}
+	server := &fakePodResources{
+		pods: []*podresourcesapi.PodResources{{Name: "train", Namespace: "ml", Containers: []*podresourcesapi.ContainerResources{
+			{Name: "worker", Devices: gaudi("B")},
+		}}},
+		// D isn't allocatable, e.g. while kubelet hasn't seen it yet.
+		allocatable: gaudi("A", "B", "C", "E"),
+	}
+	socket := servePodResources(t, server)
+	pods := newPodResources(logs.Logger(), socket, filepath.Join(t.TempDir(), "checkpoint"), "habana.ai/", time.Second, time.Minute)
+	ctx := context.Background()
+	if err := pods.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: "node-1", Annotations: map[string]string{"owner": "infra"},
+	}})
+	a := newModuleAnnotator(logs.Logger(), client, "node-1", "habana.ai/", pods, time.Minute)
+
+	// pending returns the annotations scheduled for patching, if any.
+	pending := func() *moduleAnnotations {
+		a.updates.mu.Lock()
+		defer a.updates.mu.Unlock()
+		m := a.updates.pending
+		a.updates.pending = nil
+		return m
+	}
+	features := nodeFeatures{moduleIDs: map[string]uint{"A": 0, "B": 1, "C": 2, "D": 3, "E": 4}}
+	devs := []*pluginapi.Device{
+		{ID: "A", Health: pluginapi.Healthy},
+		{ID: "B", Health: pluginapi.Healthy},
+		{ID: "C", Health: pluginapi.Unhealthy},
+		{ID: "D", Health: pluginapi.Healthy},
+		{ID: "E", Health: pluginapi.Healthy},
+		// F has no module ID.
+		{ID: "F", Health: pluginapi.Healthy},
+	}
+
+	// A and E are free: B is assigned, C unhealthy and D not allocatable.
+	a.DevicesChanged(features, devs)
+	m := pending()
+	if want := (moduleAnnotations{modules: "0,1,2,3,4", free: "0,4"}); m == nil || *m != want {
+		t.Fatalf("annotations = %+v, want %+v", m, want)
+	}
+	if err := a.apply(ctx, *m); err != nil {
+		t.Fatalf("apply() = %v", err)
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := node.Annotations; got["habana.ai/modules"] != "0,1,2,3,4" || got["habana.ai/free-modules"] != "0,4" || got["owner"] != "infra" {
+		t.Errorf("node annotations = %v", got)
+	}
+
+	// Refreshing unchanged assignments schedules nothing.
+	a.refresh()
+	if m := pending(); m != nil {
+		t.Errorf("annotations %+v scheduled again", m)
+	}
+
+	// The pod ends, freeing B.
+	server.pods = nil
+	if err := pods.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a.refresh()
+	if m := pending(); m == nil || m.free != "0,1,4" {
+		t.Errorf("annotations after the pod ended = %+v, want 0,1,4 free", m)
+	}
+
+	// Without devices the annotations are removed.
+	a.DevicesChanged(features, nil)
+	m = pending()
+	if m == nil || *m != (moduleAnnotations{}) {
+		t.Fatalf("annotations without devices = %+v", m)
+	}
+	if err := a.apply(ctx, *m); err != nil {
+		t.Fatalf("apply() = %v", err)
+	}
+	node, err = client.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.Annotations["habana.ai/modules"]; ok || node.Annotations["owner"] != "infra" {
+		t.Errorf("node annotations without devices = %v", node.Annotations)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nfdFeatureFile is the name of the file written in the Node Feature
+// Discovery features.d directory. NFD turns every line into a node label.
+const nfdFeatureFile = "habana-device-plugin"
+
+// nodeFeatures are the properties of the node's devices that don't change
+// while the plugin serves them. They are read once per device discovery.
+type nodeFeatures struct {
+	// resourceName is the extended resource the devices are advertised
+	// as. It is set by the plugin serving them.
+	resourceName string
+
+	family   string
+	model    string
+	hbmBytes uint64
+	driver   string
+	firmware string
+	// moduleIDs holds the module ID of every device by serial.
+	moduleIDs map[string]uint
+}
+
+// detectNodeFeatures reads the features of the node's devices from HLML.
+// Every device of a node is the same model, so the first one is queried.
+// Features HLML fails to report are left out.
+func detectNodeFeatures(log *slog.Logger) nodeFeatures {
+	var f nodeFeatures
+
+	if v, err := hlml.GetDeviceTypeName(); err != nil {
+		log.Debug("Failed reading device family", "error", err)
+	} else {
+		f.family = strings.ToLower(v)
+	}
+	if v, err := hlml.SystemDriverVersion(); err != nil {
+		log.Debug("Failed reading driver version", "error", err)
+	} else {
+		f.driver = v
+	}
+	if v, err := hlml.FWVersion(0); err != nil {
+		log.Debug("Failed reading firmware version", "error", err)
+	} else {
+		f.firmware = v
+	}
+
+	dev, err := hlml.DeviceHandleByIndex(0)
+	if err != nil {
+		log.Debug("Failed getting device handle", "error", err)
+		return f
+	}
+	if v, err := dev.Name(); err != nil {
+		log.Debug("Failed reading device model", "error", err)
+	} else {
+		f.model = v
+	}
+	if total, _, _, err := dev.MemoryInfo(); err != nil {
+		log.Debug("Failed reading device memory", "error", err)
+	} else {
+		f.hbmBytes = total
+	}
+	return f
+}
+
+// detectModuleIDs reads the module ID of every device of devs from HLML.
+// Devices HLML fails to report are left out.
+func detectModuleIDs(log *slog.Logger, devs []*pluginapi.Device) map[string]uint {
+	ids := make(map[string]uint, len(devs))
+	for _, d := range devs {
+		handle, err := hlml.DeviceHandleBySerial(d.ID)
+		if err != nil {
+			log.Debug("Failed getting device handle", "id", d.ID, "error", err)
+			continue
+		}
+		id, err := handle.ModuleID()
+		if err != nil {
+			log.Debug("Failed reading device module ID", "id", d.ID, "error", err)
+			continue
+		}
+		ids[d.ID] = id
+	}
+	return ids
+}
+
+// labels returns the NFD labels describing f and the devices devs, named
+// under prefix.
+func (f nodeFeatures) labels(prefix string, devs []*pluginapi.Device) map[string]string {
+	healthy := 0
+	numa := make(map[int64]int)
+	for _, d := range devs {
+		if d.Health == pluginapi.Healthy {
+			healthy++
+		}
+		if d.Topology != nil && len(d.Topology.Nodes) > 0 {
+			numa[d.Topology.Nodes[0].ID]++
+		}
+	}
+
+	labels := map[string]string{
+		"device.family":  f.family,
+		"device.model":   f.model,
+		"device.count":   strconv.Itoa(len(devs)),
+		"device.healthy": strconv.Itoa(healthy),
+		"driver.version": f.driver,
+		"numa.nodes":     strconv.Itoa(len(numa)),
+	}
+	if f.hbmBytes > 0 {
+		labels["device.hbm-bytes"] = strconv.FormatUint(f.hbmBytes, 10)
+	}
+	if f.firmware != "" {
+		labels["firmware.version"] = f.firmware
+	}
+	for node, n := range numa {
+		labels[fmt.Sprintf("numa.node-%d.devices", node)] = strconv.Itoa(n)
+	}
+
+	named := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if v = labelValue(v); v != "" {
+			named[prefix+k] = v
+		}
+	}
+	return named
+}
+
+var labelValueInvalidRe = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+
+// labelValue turns v into a valid label value: at most 63 characters
+// among alphanumerics, '-', '_' and '.', starting and ending with an
+// alphanumeric.
+func labelValue(v string) string {
+	v = labelValueInvalidRe.ReplaceAllString(v, "_")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return strings.Trim(v, "-_.")
+}
+
+// writeNodeFeatures writes labels to the feature file in dir, one
+// key=value line per label.
+func writeNodeFeatures(dir string, labels map[string]string) error {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by the Habana device plugin %s, do not edit.\n", build)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, labels[k])
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed writing NFD feature file: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, nfdFeatureFile), []byte(b.String())); err != nil {
+		return fmt.Errorf("failed writing NFD feature file: %w", err)
+	}
+	return nil
+}
+
+// removeNodeFeatures removes the feature file from dir, so that NFD drops
+// the labels.
+func removeNodeFeatures(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(dir, nfdFeatureFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed removing NFD feature file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodeConditionType is the Node condition reporting the health of the
+// devices.
+const nodeConditionType corev1.NodeConditionType = "HabanaDevicesHealthy"
+
+// Reasons of the node condition.
+const (
+	conditionDevicesHealthy   = "DevicesHealthy"
+	conditionDevicesUnhealthy = "DevicesUnhealthy"
+	conditionNoDevices        = "NoDevicesFound"
+)
+
+// nodeUnhealthyAnnotation is the annotation, under the resource prefix,
+// listing the serial numbers of the unhealthy devices, so that they stay
+// unhealthy when the plugin restarts.
+const nodeUnhealthyAnnotation = "unhealthy-devices"
+
+// nodeHealth is the health of the node's devices as reported on the Node.
+type nodeHealth struct {
+	devices   int
+	unhealthy []string
+}
+
+// nodeHealthController reports the health of the node's devices on the
+// Node object: it sets the HabanaDevicesHealthy condition and, when taint
+// is set, taints the Node while at least threshold devices are unhealthy.
+// Both are cleared when health recovers. The threshold may change while it
+// runs, with SetThreshold. The unhealthy devices are listed
+// in an annotation read back by readUnhealthyDevices. Updates are applied in
+// the background by Run.
+type nodeHealthController struct {
+	log       *slog.Logger
+	client    kubernetes.Interface
+	nodeName  string
+	prefix    string
+	condition bool
+	taint     *corev1.Taint
+	threshold atomic.Int64
+	updates   *latestUpdate[nodeHealth]
+	now       func() time.Time
+
+	mu sync.Mutex
+	// last is the health last reported, nil until the devices are known.
+	last *nodeHealth
+
+	// annotated is the value of the annotation set by the last successful
+	// patch, nil until the annotation has been patched.
+	annotated *string
+}
+
+func newNodeHealthController(log *slog.Logger, client kubernetes.Interface, nodeName, prefix string, condition bool, taint *corev1.Taint, threshold int) *nodeHealthController {
+	c := &nodeHealthController{
+		log:       log,
+		client:    client,
+		nodeName:  nodeName,
+		prefix:    prefix,
+		condition: condition,
+		taint:     taint,
+		updates:   newLatestUpdate[nodeHealth](),
+		now:       time.Now,
+	}
+	c.threshold.Store(int64(threshold))
+	return c
+}
+
+// SetThreshold changes the number of unhealthy devices from which the node
+// is reported failed, reporting the last health again when it changes.
+func (c *nodeHealthController) SetThreshold(threshold int) {
+	if c.threshold.Swap(int64(threshold)) == int64(threshold) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil {
+		c.updates.Set(*c.last)
+	}
+}
+
+// DevicesChanged schedules reporting the health of devs.
+func (c *nodeHealthController) DevicesChanged(_ nodeFeatures, devs []*pluginapi.Device) {
+	h := nodeHealth{devices: len(devs)}
+	for _, d := range devs {
+		if d.Health != pluginapi.Healthy {
+			h.unhealthy = append(h.unhealthy, d.ID)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = &h
+	c.updates.Set(h)
+}
+
+// Run updates the Node with the pending health reports until ctx is done.
+func (c *nodeHealthController) Run(ctx context.Context) {
+	c.updates.Run(ctx, c.log.With("node", c.nodeName), "Failed updating node health, retrying", c.apply)
+}
+
+// failed reports whether h crosses the threshold of unhealthy devices.
+func (c *nodeHealthController) failed(h nodeHealth) bool {
+	return h.devices > 0 && int64(len(h.unhealthy)) >= c.threshold.Load()
+}
+
+func (c *nodeHealthController) apply(ctx context.Context, h nodeHealth) error {
+	// The annotation goes first, a taint must not outlive a restart
+	// forgetting why it was applied.
+	if err := c.setAnnotation(ctx, h); err != nil {
+		return err
+	}
+	if c.condition {
+		if err := c.setCondition(ctx, h); err != nil {
+			return err
+		}
+	}
+	if c.taint != nil {
+		if err := c.setTaint(ctx, c.failed(h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCondition patches the HabanaDevicesHealthy condition of the Node,
+// keeping its transition time unless its status changes.
+func (c *nodeHealthController) setCondition(ctx context.Context, h nodeHealth) error {
+	cond := corev1.NodeCondition{
+		Type:    nodeConditionType,
+		Status:  corev1.ConditionTrue,
+		Reason:  conditionDevicesHealthy,
+		Message: fmt.Sprintf("%d Habana devices are healthy", h.devices),
+	}
+	switch {
+	case h.devices == 0:
+		cond.Status, cond.Reason, cond.Message = corev1.ConditionUnknown, conditionNoDevices, "No Habana devices found"
+	case c.failed(h):
+		cond.Status, cond.Reason = corev1.ConditionFalse, conditionDevicesUnhealthy
+		cond.Message = fmt.Sprintf("%d of %d Habana devices are unhealthy: %s", len(h.unhealthy), h.devices, strings.Join(h.unhealthy, ", "))
+	case len(h.unhealthy) > 0:
+		cond.Message = fmt.Sprintf("%d of %d Habana devices are unhealthy, below the threshold of %d: %s",
+			len(h.unhealthy), h.devices, c.threshold.Load(), strings.Join(h.unhealthy, ", "))
+	}
+
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed getting node: %w", err)
+	}
+	now := metav1.NewTime(c.now())
+	cond.LastHeartbeatTime, cond.LastTransitionTime = now, now
+	for _, cur := range node.Status.Conditions {
+		if cur.Type == nodeConditionType && cur.Status == cond.Status {
+			cond.LastTransitionTime = cur.LastTransitionTime
+		}
+	}
+
+	// Conditions are merged by type, leaving the others untouched.
+	patch, err := json.Marshal(map[string]any{
+		"status": map[string]any{"conditions": []corev1.NodeCondition{cond}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.client.CoreV1().Nodes().PatchStatus(ctx, c.nodeName, patch); err != nil {
+		return fmt.Errorf("failed setting node condition: %w", err)
+	}
+	c.log.Debug("Updated node condition", "node", c.nodeName, "status", cond.Status, "reason", cond.Reason)
+	return nil
+}
+
+// setAnnotation lists the unhealthy devices of h in the annotation of the
+// Node, removing it when there are none.
+func (c *nodeHealthController) setAnnotation(ctx context.Context, h nodeHealth) error {
+	value := strings.Join(slices.Sorted(slices.Values(h.unhealthy)), ",")
+	if c.annotated != nil && *c.annotated == value {
+		return nil
+	}
+
+	var annotation *string
+	if value != "" {
+		annotation = &value
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": map[string]*string{c.prefix + nodeUnhealthyAnnotation: annotation}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.CoreV1().Nodes().Patch(ctx, c.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed annotating node: %w", err)
+	}
+	c.annotated = &value
+	return nil
+}
+
+// readUnhealthyDevices returns the devices listed unhealthy on the Node
+// nodeName by a previous run of the plugin.
+func readUnhealthyDevices(ctx context.Context, client kubernetes.Interface, nodeName, prefix string) ([]string, error) {
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting node: %w", err)
+	}
+	value := node.Annotations[prefix+nodeUnhealthyAnnotation]
+	if value == "" {
+		return nil, nil
+	}
+	return strings.Split(value, ","), nil
+}
+
+// setTaint adds the taint to the Node when tainted is set and removes it
+// otherwise. Taints are replaced as a whole, so the Node is updated with
+// its resource version and the update retried on conflicts.
+func (c *nodeHealthController) setTaint(ctx context.Context, tainted bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed getting node: %w", err)
+		}
+
+		i := slices.IndexFunc(node.Spec.Taints, func(t corev1.Taint) bool { return c.taint.MatchTaint(&t) })
+		switch {
+		case tainted && i < 0:
+			taint := *c.taint
+			taint.TimeAdded = ptr(metav1.NewTime(c.now()))
+			node.Spec.Taints = append(node.Spec.Taints, taint)
+		case !tainted && i >= 0:
+			node.Spec.Taints = slices.Delete(node.Spec.Taints, i, i+1)
+		default:
+			return nil
+		}
+
+		if _, err := c.client.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		if tainted {
+			c.log.Warn("Tainted node, too many unhealthy devices", "node", c.nodeName, "taint", c.taint.ToString())
+		} else {
+			c.log.Info("Removed node taint, devices recovered", "node", c.nodeName, "taint", c.taint.ToString())
+		}
+		return nil
+	})
+}
+
+// parseTaint parses a taint in the key[=value]:effect form of kubectl
+// taint.
+func parseTaint(s string) (*corev1.Taint, error) {
+	spec, effect, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, errors.New("must be of the form key[=value]:effect")
+	}
+	key, value, _ := strings.Cut(spec, "=")
+
+	var errs []error
+	for _, msg := range validation.IsQualifiedName(key) {
+		errs = append(errs, fmt.Errorf("key: %s", msg))
+	}
+	for _, msg := range validation.IsValidLabelValue(value) {
+		errs = append(errs, fmt.Errorf("value: %s", msg))
+	}
+	switch e := corev1.TaintEffect(effect); e {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		errs = append(errs, fmt.Errorf("effect: must be %s, %s or %s, got %q",
+			corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute, e))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &corev1.Taint{Key: key, Value: value, Effect: corev1.TaintEffect(effect)}, nil
+}
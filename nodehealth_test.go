@@ -0,0 +1,196 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodeCondition returns the condition t of node, or nil.
+func nodeCondition(node *corev1.Node, t corev1.NodeConditionType) *corev1.NodeCondition {
+	for i, c := range node.Status.Conditions {
+		if c.Type == t {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestNodeHealthController(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := corev1.Taint{Key: "example.com/maintenance", Effect: corev1.TaintEffectNoSchedule}
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       corev1.NodeSpec{Taints: []corev1.Taint{other}},
+		Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+			{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+		}},
+	})
+	// The first update conflicts with a concurrent one.
+	updates, conflicts := 0, 1
+	client.PrependReactor("update", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "node-1", errors.New("stale"))
+		}
+		return false, nil, nil
+	})
+	taint, err := parseTaint("habana.ai/unhealthy=true:NoSchedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newController := func(now time.Time) *nodeHealthController {
+		c := newNodeHealthController(logs.Logger(), client, "node-1", "habana.ai/", true, taint, 1)
+		c.now = func() time.Time { return now }
+		return c
+	}
+	getNode := func() *corev1.Node {
+		node, err := client.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	hasTaint := func(node *corev1.Node) bool {
+		return slices.ContainsFunc(node.Spec.Taints, func(t corev1.Taint) bool { return taint.MatchTaint(&t) })
+	}
+
+	c := newController(start)
+	failed := nodeHealth{devices: 8, unhealthy: []string{"B", "A"}}
+	if err := c.apply(ctx, failed); err != nil {
+		t.Fatalf("apply() = %v", err)
+	}
+	node := getNode()
+	cond := nodeCondition(node, nodeConditionType)
+	if cond == nil || cond.Status != corev1.ConditionFalse || cond.Reason != conditionDevicesUnhealthy ||
+		cond.Message != "2 of 8 Habana devices are unhealthy: B, A" || !cond.LastTransitionTime.Time.Equal(start) {
+		t.Errorf("condition = %+v", cond)
+	}
+	if nodeCondition(node, corev1.NodeReady) == nil {
+		t.Error("the Ready condition was removed")
+	}
+	if !hasTaint(node) || !slices.ContainsFunc(node.Spec.Taints, func(t corev1.Taint) bool { return t.MatchTaint(&other) }) {
+		t.Errorf("taints = %v, want the unhealthy taint added", node.Spec.Taints)
+	}
+	if updates != 2 {
+		t.Errorf("node updated %d times, want a retry after the conflict", updates)
+	}
+	if v := node.Annotations["habana.ai/unhealthy-devices"]; v != "A,B" {
+		t.Errorf("unhealthy-devices annotation = %q, want A,B", v)
+	}
+
+	// The plugin restarts and keeps the devices unhealthy.
+	unhealthy, err := readUnhealthyDevices(ctx, client, "node-1", "habana.ai/")
+	if err != nil || !slices.Equal(unhealthy, []string{"A", "B"}) {
+		t.Fatalf("readUnhealthyDevices() = %v, %v", unhealthy, err)
+	}
+	c = newController(start.Add(time.Hour))
+	updates = 0
+	if err := c.apply(ctx, nodeHealth{devices: 8, unhealthy: unhealthy}); err != nil {
+		t.Fatalf("apply() = %v", err)
+	}
+	node = getNode()
+	cond = nodeCondition(node, nodeConditionType)
+	if cond == nil || cond.Status != corev1.ConditionFalse || !cond.LastTransitionTime.Time.Equal(start) ||
+		!cond.LastHeartbeatTime.Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("condition after restart = %+v, want it kept", cond)
+	}
+	if !hasTaint(node) || updates != 0 {
+		t.Errorf("taints after restart = %v, %d updates, want them kept", node.Spec.Taints, updates)
+	}
+
+	// The devices recover.
+	if err := c.apply(ctx, nodeHealth{devices: 8}); err != nil {
+		t.Fatalf("apply() = %v", err)
+	}
+	node = getNode()
+	cond = nodeCondition(node, nodeConditionType)
+	if cond == nil || cond.Status != corev1.ConditionTrue || cond.Reason != conditionDevicesHealthy ||
+		!cond.LastTransitionTime.Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("condition after recovery = %+v", cond)
+	}
+	if hasTaint(node) || len(node.Spec.Taints) != 1 {
+		t.Errorf("taints after recovery = %v, want only the others", node.Spec.Taints)
+	}
+	if v, ok := node.Annotations["habana.ai/unhealthy-devices"]; ok {
+		t.Errorf("unhealthy-devices annotation = %q after recovery, want it removed", v)
+	}
+}
+
+func TestNodeHealthThreshold(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newNodeHealthController(logs.Logger(), nil, "node-1", "habana.ai/", true, nil, 2)
+	// pending returns the health scheduled for reporting, if any.
+	pending := func() *nodeHealth {
+		c.updates.mu.Lock()
+		defer c.updates.mu.Unlock()
+		h := c.updates.pending
+		c.updates.pending = nil
+		return h
+	}
+
+	c.SetThreshold(3)
+	if h := pending(); h != nil {
+		t.Errorf("health %+v scheduled before any device is known", h)
+	}
+
+	c.DevicesChanged(nodeFeatures{}, []*pluginapi.Device{
+		{ID: "A", Health: pluginapi.Unhealthy},
+		{ID: "B", Health: pluginapi.Healthy},
+	})
+	h := pending()
+	if h == nil || c.failed(*h) {
+		t.Fatalf("health %+v, want one unhealthy device below the threshold", h)
+	}
+
+	// Lowering the threshold reports the same health again, now failed.
+	c.SetThreshold(1)
+	h = pending()
+	if h == nil || !c.failed(*h) {
+		t.Errorf("health after lowering the threshold = %+v, want it reported failed", h)
+	}
+	c.SetThreshold(1)
+	if h := pending(); h != nil {
+		t.Errorf("health %+v scheduled again for an unchanged threshold", h)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// Ways of registering with kubelet.
+const (
+	// registrationModeKubelet registers by calling kubelet's Registration
+	// service on the kubelet socket.
+	registrationModeKubelet = "kubelet"
+	// registrationModePluginWatcher serves the plugin registration service
+	// in the plugins registry directory, where kubelet's plugin watcher
+	// discovers it.
+	registrationModePluginWatcher = "pluginwatcher"
+)
+
+// registrationStatus is the outcome of a registration as reported by
+// kubelet in pluginwatcher mode.
+type registrationStatus struct {
+	registered bool
+	err        string
+}
+
+// registrationServer implements the kubelet plugin registration service.
+// Kubelet calls GetInfo on discovering the socket, connects to the device
+// plugin endpoint it returns, and reports the result back through
+// NotifyRegistrationStatus.
+type registrationServer struct {
+	registerapi.UnimplementedRegistrationServer
+
+	log          *slog.Logger
+	resourceName string
+	endpoint     string
+	status       chan<- registrationStatus
+}
+
+// GetInfo describes the device plugin to kubelet.
+func (r *registrationServer) GetInfo(ctx context.Context, _ *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	loggerFromContext(ctx, r.log).Info("Kubelet discovered the device plugin", "resource_name", r.resourceName, "endpoint", r.endpoint)
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              r.resourceName,
+		Endpoint:          r.endpoint,
+		SupportedVersions: []string{pluginapi.Version},
+	}, nil
+}
+
+// NotifyRegistrationStatus receives the result of the registration from
+// kubelet.
+func (r *registrationServer) NotifyRegistrationStatus(ctx context.Context, s *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	select {
+	case r.status <- registrationStatus{registered: s.PluginRegistered, err: s.Error}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// startRegistrationServer serves the registration service on the plugin's
+// registration socket until ctx is done.
+func (m *HabanalabsDevicePlugin) startRegistrationServer(ctx context.Context) error {
+	if err := os.Remove(m.registrationSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sock, err := net.Listen("unix", m.registrationSocket)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer(serverInterceptors(m.grpcLog)...)
+	registerapi.RegisterRegistrationServer(server, &registrationServer{
+		log:          m.grpcLog,
+		resourceName: m.resourceName,
+		endpoint:     m.socket,
+		status:       m.registration,
+	})
+
+	m.group.Go(func() error {
+		if err := server.Serve(sock); err != nil {
+			return fmt.Errorf("registration server failed: %w", err)
+		}
+		return nil
+	})
+	m.group.Go(func() error {
+		<-ctx.Done()
+		server.Stop()
+		return nil
+	})
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// podAssignment is a container a device is assigned to. Pods read from
+// kubelet's checkpoint are only known by UID.
+type podAssignment struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	PodUID    string `json:"podUID,omitempty"`
+	Container string `json:"container"`
+}
+
+func (a podAssignment) String() string {
+	if a.Pod == "" {
+		return a.PodUID + "/" + a.Container
+	}
+	return a.Namespace + "/" + a.Pod + "/" + a.Container
+}
+
+// podResources keeps the assignment of the plugin's devices to containers,
+// polled from kubelet's PodResources API, or read from kubelet's device
+// manager checkpoint when socket is empty. Devices are those of resources
+// under prefix.
+type podResources struct {
+	log        *slog.Logger
+	socket     string
+	checkpoint string
+	prefix     string
+	timeout    time.Duration
+	interval   time.Duration
+
+	mu          sync.RWMutex
+	assignments map[string][]podAssignment
+	// allocatable holds the devices kubelet may allocate, nil when kubelet
+	// doesn't report them.
+	allocatable map[string]bool
+}
+
+func newPodResources(log *slog.Logger, socket, checkpoint, prefix string, timeout, interval time.Duration) *podResources {
+	return &podResources{
+		log:        log,
+		socket:     socket,
+		checkpoint: checkpoint,
+		prefix:     prefix,
+		timeout:    timeout,
+		interval:   interval,
+	}
+}
+
+// Run polls kubelet until ctx is done. Kubelet being unreachable is logged
+// once until it answers again; the last known assignments are kept
+// meanwhile.
+func (p *podResources) Run(ctx context.Context) {
+	log := p.log.With("socket", p.socket)
+	if p.socket == "" {
+		log = p.log.With("checkpoint", p.checkpoint)
+	}
+
+	var failing bool
+	for {
+		if err := p.Sync(ctx); err != nil {
+			if !failing && ctx.Err() == nil {
+				log.Warn("Failed listing pod resources from kubelet", "error", err)
+			}
+			failing = true
+		} else if failing {
+			log.Info("Listing pod resources from kubelet again")
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// Sync lists the pod resources from kubelet and replaces the assignments.
+func (p *podResources) Sync(ctx context.Context) error {
+	if p.socket == "" {
+		return p.LoadCheckpoint()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	conn, err := dial(p.socket, p.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+
+	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed listing pod resources: %w", err)
+	}
+	assignments := make(map[string][]podAssignment)
+	for _, pod := range resp.GetPodResources() {
+		for _, c := range pod.GetContainers() {
+			a := podAssignment{Namespace: pod.GetNamespace(), Pod: pod.GetName(), Container: c.GetName()}
+			for _, id := range p.devices(c.GetDevices()) {
+				assignments[id] = append(assignments[id], a)
+			}
+		}
+	}
+
+	// GetAllocatableResources is behind a feature gate on older kubelets.
+	var allocatable map[string]bool
+	alloc, err := client.GetAllocatableResources(ctx, &podresourcesapi.AllocatableResourcesRequest{})
+	switch {
+	case err == nil:
+		allocatable = make(map[string]bool)
+		for _, id := range p.devices(alloc.GetDevices()) {
+			allocatable[id] = true
+		}
+	case status.Code(err) != codes.Unimplemented:
+		return fmt.Errorf("failed getting allocatable resources: %w", err)
+	}
+
+	p.mu.Lock()
+	p.assignments, p.allocatable = assignments, allocatable
+	p.mu.Unlock()
+
+	updateAssignmentMetrics(assignments)
+	return nil
+}
+
+// LoadCheckpoint replaces the assignments with those of kubelet's device
+// manager checkpoint, which kubelet writes on every allocation. It seeds
+// the assignments on startup, before kubelet answers. A missing checkpoint
+// holds no assignments.
+func (p *podResources) LoadCheckpoint() error {
+	assignments, err := readKubeletCheckpoint(p.checkpoint, p.prefix)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		assignments = make(map[string][]podAssignment)
+	case err != nil:
+		return err
+	}
+
+	p.mu.Lock()
+	p.assignments = assignments
+	p.mu.Unlock()
+
+	updateAssignmentMetrics(assignments)
+	return nil
+}
+
+// devices returns the IDs of the plugin's devices among devs.
+func (p *podResources) devices(devs []*podresourcesapi.ContainerDevices) []string {
+	var ids []string
+	for _, d := range devs {
+		if strings.HasPrefix(d.GetResourceName(), p.prefix) {
+			ids = append(ids, d.GetDeviceIds()...)
+		}
+	}
+	return ids
+}
+
+// Assignments returns the containers the device with serial id is
+// assigned to.
+func (p *podResources) Assignments(id string) []podAssignment {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.assignments[id]
+}
+
+// Allocatable reports whether kubelet may allocate the device with serial
+// id. ok is false when kubelet doesn't tell.
+func (p *podResources) Allocatable(id string) (allocatable, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.allocatable == nil {
+		return false, false
+	}
+	return p.allocatable[id], true
+}
+
+// Pods returns references to the pods using the device with serial id,
+// for recording events on them. Pods only known by UID are left out.
+func (p *podResources) Pods(id string) []*corev1.ObjectReference {
+	var refs []*corev1.ObjectReference
+	seen := make(map[podAssignment]bool)
+	for _, a := range p.Assignments(id) {
+		a.Container = ""
+		if a.Pod == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		refs = append(refs, &corev1.ObjectReference{Kind: "Pod", Namespace: a.Namespace, Name: a.Pod})
+	}
+	return refs
+}
+
+// Users returns the containers using the device with serial id, as
+// namespace/pod/container, for logging. p may be nil.
+func (p *podResources) Users(id string) []string {
+	if p == nil {
+		return nil
+	}
+	var users []string
+	for _, a := range p.Assignments(id) {
+		users = append(users, a.String())
+	}
+	return users
+}
@@ -0,0 +1,152 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakePodResources serves pods and, unless allocatable is nil, the
+// allocatable devices. An older kubelet answers Unimplemented for them.
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	pods        []*podresourcesapi.PodResources
+	allocatable []*podresourcesapi.ContainerDevices
+	err         error
+}
+
+func (s *fakePodResources) List(context.Context, *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: s.pods}, nil
+}
+
+func (s *fakePodResources) GetAllocatableResources(ctx context.Context, req *podresourcesapi.AllocatableResourcesRequest) (*podresourcesapi.AllocatableResourcesResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.allocatable == nil {
+		return s.UnimplementedPodResourcesListerServer.GetAllocatableResources(ctx, req)
+	}
+	return &podresourcesapi.AllocatableResourcesResponse{Devices: s.allocatable}, nil
+}
+
+// servePodResources serves s on a unix socket in a temporary directory and
+// returns the socket.
+func servePodResources(t *testing.T, s *fakePodResources) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, s)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+func TestPodResourcesSync(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaudi := func(ids ...string) *podresourcesapi.ContainerDevices {
+		return &podresourcesapi.ContainerDevices{ResourceName: "habana.ai/gaudi", DeviceIds: ids}
+	}
+	server := &fakePodResources{
+		pods: []*podresourcesapi.PodResources{
+			{Name: "train", Namespace: "ml", Containers: []*podresourcesapi.ContainerResources{
+				{Name: "worker", Devices: []*podresourcesapi.ContainerDevices{gaudi("A", "B")}},
+				{Name: "sidecar", Devices: []*podresourcesapi.ContainerDevices{gaudi("B")}},
+			}},
+			{Name: "render", Namespace: "gfx", Containers: []*podresourcesapi.ContainerResources{
+				{Name: "main", Devices: []*podresourcesapi.ContainerDevices{
+					{ResourceName: "example.com/gpu", DeviceIds: []string{"C"}},
+				}},
+			}},
+		},
+		allocatable: []*podresourcesapi.ContainerDevices{
+			gaudi("A", "B", "D"),
+			{ResourceName: "example.com/gpu", DeviceIds: []string{"C"}},
+		},
+	}
+	socket := servePodResources(t, server)
+	p := newPodResources(logs.Logger(), socket, filepath.Join(t.TempDir(), "checkpoint"), "habana.ai/", time.Second, time.Minute)
+
+	ctx := context.Background()
+	if err := p.Sync(ctx); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	want := []podAssignment{
+		{Namespace: "ml", Pod: "train", Container: "worker"},
+		{Namespace: "ml", Pod: "train", Container: "sidecar"},
+	}
+	if got := p.Assignments("B"); !slices.Equal(got, want) {
+		t.Errorf("Assignments(B) = %v, want %v", got, want)
+	}
+	if got := p.Assignments("C"); got != nil {
+		t.Errorf("Assignments(C) = %v, want none of another resource", got)
+	}
+	if got := p.Users("A"); !slices.Equal(got, []string{"ml/train/worker"}) {
+		t.Errorf("Users(A) = %v", got)
+	}
+	if refs := p.Pods("B"); len(refs) != 1 || refs[0].Name != "train" || refs[0].Namespace != "ml" {
+		t.Errorf("Pods(B) = %v, want the pod once", refs)
+	}
+	for id, want := range map[string]bool{"A": true, "D": true, "C": false, "E": false} {
+		if allocatable, ok := p.Allocatable(id); !ok || allocatable != want {
+			t.Errorf("Allocatable(%s) = %t, %t, want %t, true", id, allocatable, ok, want)
+		}
+	}
+
+	// An older kubelet doesn't report the allocatable devices.
+	server.allocatable = nil
+	server.pods = server.pods[:1]
+	server.pods[0].Containers = server.pods[0].Containers[:1]
+	if err := p.Sync(ctx); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if _, ok := p.Allocatable("A"); ok {
+		t.Error("Allocatable() known after Unimplemented")
+	}
+	if got := p.Assignments("B"); !slices.Equal(got, want[:1]) {
+		t.Errorf("Assignments(B) = %v, want %v", got, want[:1])
+	}
+
+	// Other failures keep the last assignments.
+	server.err = status.Error(codes.Unavailable, "restarting")
+	if err := p.Sync(ctx); status.Code(err) != codes.Unavailable {
+		t.Errorf("Sync() = %v, want Unavailable", err)
+	}
+	if got := p.Assignments("B"); !slices.Equal(got, want[:1]) {
+		t.Errorf("Assignments(B) after a failure = %v, want %v", got, want[:1])
+	}
+}
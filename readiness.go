@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Plugin states reported by the readiness endpoint.
+const (
+	stateStarting          = "starting"
+	stateWaitingForDevices = "waiting-for-devices"
+	stateRegistering       = "registering"
+	stateRegistered        = "registered"
+	stateStopping          = "stopping"
+)
+
+// readiness tracks whether the plugin is registered with kubelet, and why
+// not when it isn't. It backs the /readyz endpoint.
+type readiness struct {
+	mu     sync.RWMutex
+	state  string
+	reason string
+	since  time.Time
+}
+
+func newReadiness() *readiness {
+	return &readiness{state: stateStarting, since: time.Now()}
+}
+
+// Set records the current state of the plugin with a human readable reason.
+func (r *readiness) Set(state, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state != state {
+		r.since = time.Now()
+	}
+	r.state, r.reason = state, reason
+	registeredGauge.Set(boolToFloat(state == stateRegistered))
+}
+
+// State returns the current state of the plugin.
+func (r *readiness) State() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+// ServeHTTP answers readiness probes: 200 when registered, 503 otherwise.
+// The body describes the current state either way.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.RLock()
+	body := struct {
+		State  string    `json:"state"`
+		Reason string    `json:"reason,omitempty"`
+		Since  time.Time `json:"since"`
+	}{r.state, r.reason, r.since}
+	ready := r.state == stateRegistered
+	r.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configMapDataDir is the symlink Kubernetes swaps atomically when a
+// ConfigMap volume is updated.
+const configMapDataDir = "..data"
+
+// watchConfig adds the directory of the configuration file to watcher.
+// Watching the directory rather than the file survives editors and
+// ConfigMap updates replacing the file.
+func watchConfig(watcher *fsnotify.Watcher, cfg *Config) error {
+	if cfg.ConfigFile == "" {
+		return nil
+	}
+	return watcher.Add(filepath.Dir(cfg.ConfigFile))
+}
+
+// isConfigEvent reports whether event may have changed the configuration
+// file.
+func isConfigEvent(cfg *Config, event fsnotify.Event) bool {
+	if cfg.ConfigFile == "" || event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+		return false
+	}
+	if filepath.Dir(event.Name) != filepath.Dir(cfg.ConfigFile) {
+		return false
+	}
+	base := filepath.Base(event.Name)
+	return base == filepath.Base(cfg.ConfigFile) || base == configMapDataDir
+}
+
+// reloadConfig loads the configuration again and applies every change that
+// does not need the device plugin to re-register with kubelet, as tagged in
+// Config. It returns the configuration now in effect and whether the device
+// plugin must be restarted to apply the rest. An invalid configuration is
+// logged and ignored. plugin is nil while no devices have been found, and
+// reports may be nil in tests.
+func reloadConfig(log *slog.Logger, logs *logging, plugin *HabanalabsDevicePlugin, reports *reporting, cur *Config, load func() (*Config, error)) (*Config, bool) {
+	cfg, err := load()
+	if err != nil {
+		log.Error("Failed reloading configuration, keeping the current one", "error", err)
+		return cur, false
+	}
+	if *cfg == *cur {
+		log.Debug("Configuration unchanged")
+		return cur, false
+	}
+
+	if cfg.LogLevel != cur.LogLevel {
+		var lvl slog.Level
+		_ = lvl.UnmarshalText([]byte(cfg.LogLevel)) // validated by load
+		_ = logs.SetLevel("", lvl)
+		log.Info("Log level changed", "level", lvl)
+	}
+
+	restart := false
+	cv, nv := reflect.ValueOf(cur).Elem(), reflect.ValueOf(cfg).Elem()
+	for i := range nv.NumField() {
+		f, old, requested := nv.Type().Field(i), cv.Field(i), nv.Field(i)
+		if old.Equal(requested) {
+			continue
+		}
+		switch f.Tag.Get("reload") {
+		case "process":
+			log.Warn("Configuration change requires restarting the plugin process, keeping the current value",
+				"field", yamlName(f), "current", old.Interface(), "requested", requested.Interface())
+			requested.Set(old)
+		case "plugin":
+			restart = true
+		}
+	}
+
+	pciBasePath = cfg.HostPath(cfg.PCIDevicesPath)
+	if plugin != nil {
+		plugin.Reconfigure(cfg)
+	}
+	if reports != nil {
+		reports.Reconfigure(cfg)
+	}
+	log.Info("Configuration reloaded", "config_file", cfg.ConfigFile)
+	return cfg, restart
+}
+
+// yamlName returns the configuration file key of the Config field f.
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	return name
+}
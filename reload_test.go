@@ -0,0 +1,163 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logs.Logger()
+
+	for _, tc := range []struct {
+		name    string
+		change  func(*Config)
+		restart bool
+		// want is the configuration applied, the requested one when nil.
+		want func(*Config)
+	}{
+		{
+			name:   "in place",
+			change: func(c *Config) { c.LogLevel, c.DeviceDenyList, c.AllocateEnv = "DEBUG", "3,SERIAL", "A={{.Count}}" },
+		},
+		{
+			name:    "resource prefix",
+			change:  func(c *Config) { c.ResourcePrefix = "example.com/" },
+			restart: true,
+		},
+		{
+			name:   "features path",
+			change: func(c *Config) { c.NFDFeaturesPath = "/etc/features.d" },
+		},
+		{
+			name:    "registration mode",
+			change:  func(c *Config) { c.RegistrationMode = registrationModePluginWatcher },
+			restart: true,
+		},
+		{
+			name: "process restart",
+			change: func(c *Config) {
+				c.NodeName, c.UnhealthyThreshold, c.HealthCheckInterval = "node-2", 3, 2*c.HealthCheckInterval
+			},
+			want: func(c *Config) { c.UnhealthyThreshold, c.HealthCheckInterval = 3, 2*c.HealthCheckInterval },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cur := defaultConfig()
+			requested := defaultConfig()
+			tc.change(requested)
+			reports := &reporting{nodeHealth: newNodeHealthController(log, nil, cur.NodeName, cur.ResourcePrefix, true, nil, cur.UnhealthyThreshold)}
+			got, restart := reloadConfig(log, logs, nil, reports, cur, func() (*Config, error) { return requested, nil })
+			if restart != tc.restart {
+				t.Errorf("restart = %t, want %t", restart, tc.restart)
+			}
+			want := defaultConfig()
+			if tc.want != nil {
+				tc.want(want)
+			} else {
+				tc.change(want)
+			}
+			if *got != *want {
+				t.Errorf("applied configuration = %+v, want %+v", got, want)
+			}
+			if threshold := reports.nodeHealth.threshold.Load(); threshold != int64(want.UnhealthyThreshold) {
+				t.Errorf("node health threshold = %d, want %d", threshold, want.UnhealthyThreshold)
+			}
+		})
+	}
+}
+
+func TestReloadTags(t *testing.T) {
+	typ := reflect.TypeFor[Config]()
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+		switch tag := f.Tag.Get("reload"); tag {
+		case "", "process", "plugin":
+		default:
+			t.Errorf("%s: unknown reload tag %q", f.Name, tag)
+		}
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	modules := map[string]uint{"A": 0, "B": 1, "C": 2}
+	for _, tc := range []struct {
+		allow, deny string
+		want        []string
+	}{
+		{"", "", []string{"A", "B", "C"}},
+		{"", "B", []string{"A", "C"}},
+		{"", "2, A", []string{"B"}},
+		{"0,C", "", []string{"A", "C"}},
+		{"0,C", "0", []string{"C"}},
+	} {
+		filter, err := newDeviceFilter(&Config{DeviceAllowList: tc.allow, DeviceDenyList: tc.deny})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, id := range []string{"A", "B", "C"} {
+			if filter.allows(id, modules) {
+				got = append(got, id)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("allow %q, deny %q: allowed %v, want %v", tc.allow, tc.deny, got, tc.want)
+		}
+	}
+
+	if _, err := newDeviceFilter(&Config{DeviceDenyList: "a=b"}); err == nil {
+		t.Error("newDeviceFilter() accepted an invalid device")
+	}
+}
+
+func TestEnvTemplates(t *testing.T) {
+	templates, err := parseEnvTemplates("LOGS=/var/log/{{.Modules}}, COUNT={{.Count}},")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"HL_VISIBLE_DEVICES": "/dev/accel/accel0"}
+	err = renderEnvTemplates(templates, allocation{Count: 2, Modules: "0,1"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"HL_VISIBLE_DEVICES": "/dev/accel/accel0", "LOGS": "/var/log/0,1", "COUNT": "2"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+
+	for _, s := range []string{
+		"NOVALUE",
+		"1A=x",
+		"HL_VISIBLE_DEVICES=x",
+		"A={{.Count",
+		"A={{.Unknown}}",
+	} {
+		if _, err := parseEnvTemplates(s); err == nil {
+			t.Errorf("parseEnvTemplates(%q) succeeded", s)
+		}
+	}
+}
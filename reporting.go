@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// unhealthyReadTimeout bounds reading the devices left unhealthy by a
+// previous run from the Node.
+const unhealthyReadTimeout = 10 * time.Second
+
+// reporting reports the devices served, and their health, beyond kubelet:
+// to the inventory endpoint and to the enabled device observers. It is
+// itself the device observer of the device plugin.
+type reporting struct {
+	observers []deviceObserver
+	pods      *podResources
+	inventory *deviceInventory
+	// unhealthy are the devices a previous run of the plugin reported
+	// unhealthy on the Node, when node health is reported.
+	unhealthy []string
+	// nodeHealth reports the health of the devices on the Node, when
+	// enabled.
+	nodeHealth *nodeHealthController
+
+	background sync.WaitGroup
+	stop       []func()
+}
+
+// startReporting starts the reporting enabled by cfg. The goroutines it
+// starts run until ctx is done; Stop waits for them.
+func startReporting(ctx context.Context, log *slog.Logger, logs *logging, cfg *Config) (*reporting, error) {
+	r := &reporting{}
+
+	// The assignments that survived a restart of the plugin are known from
+	// kubelet's checkpoint until the PodResources API answers, or for good
+	// when it isn't used.
+	r.pods = newPodResources(log, cfg.PodResourcesSocket, cfg.KubeletCheckpoint(), cfg.ResourcePrefix, cfg.KubeletDialTimeout, cfg.PodResourcesInterval)
+	if err := r.pods.LoadCheckpoint(); err != nil {
+		log.Warn("Failed reading device assignments from kubelet checkpoint", "error", err)
+	}
+	r.background.Go(func() { r.pods.Run(ctx) })
+	r.inventory = newDeviceInventory(r.pods)
+	r.observers = append(r.observers, r.inventory)
+
+	actions, _ := parseFailedDeviceActions(cfg.FailedDeviceActions) // validated by load
+
+	clients := &kubeClients{kubeconfig: cfg.Kubeconfig}
+	var client kubernetes.Interface
+	if cfg.NodeLabels || cfg.HealthEvents || cfg.NodeCondition || cfg.UnhealthyTaint != "" || len(actions) > 0 || cfg.ModuleAnnotations || cfg.DeviceObjects {
+		var err error
+		if client, err = clients.clientset(); err != nil {
+			return nil, err
+		}
+	}
+	var dynamicClient dynamic.Interface
+	if cfg.NodeResourceTopology || cfg.DeviceObjects {
+		var err error
+		if dynamicClient, err = clients.dynamicClient(); err != nil {
+			return nil, err
+		}
+	}
+	var recorder record.EventRecorder
+	if cfg.HealthEvents || slices.Contains(actions, failedDeviceEvent) {
+		var broadcaster record.EventBroadcaster
+		broadcaster, recorder = newEventBroadcaster(client, cfg.NodeName)
+		r.stop = append(r.stop, broadcaster.Shutdown)
+	}
+
+	nodeHealth := cfg.NodeCondition || cfg.UnhealthyTaint != ""
+	if nodeHealth {
+		readCtx, cancel := context.WithTimeout(ctx, unhealthyReadTimeout)
+		unhealthy, err := readUnhealthyDevices(readCtx, client, cfg.NodeName, cfg.ResourcePrefix)
+		cancel()
+		if err != nil {
+			log.Warn("Failed reading the unhealthy devices from the node, assuming none", "error", err)
+		} else if len(unhealthy) > 0 {
+			log.Info("Devices reported unhealthy before restarting", "ids", unhealthy)
+		}
+		r.unhealthy = unhealthy
+	}
+
+	if cfg.NodeLabels {
+		labeler := newNodeLabeler(log, client, cfg.NodeName, cfg.ResourcePrefix)
+		r.background.Go(func() { labeler.Run(ctx) })
+		r.observers = append(r.observers, labeler)
+	}
+	if cfg.HealthEvents {
+		r.observers = append(r.observers, newHealthEvents(logs.For(subsystemHealth), recorder, cfg.NodeName, r.pods.Pods, r.unhealthy))
+	}
+	if nodeHealth {
+		var taint *corev1.Taint
+		if cfg.UnhealthyTaint != "" {
+			taint, _ = parseTaint(cfg.UnhealthyTaint) // validated by load
+		}
+		r.nodeHealth = newNodeHealthController(logs.For(subsystemHealth), client, cfg.NodeName, cfg.ResourcePrefix, cfg.NodeCondition, taint, cfg.UnhealthyThreshold)
+		r.background.Go(func() { r.nodeHealth.Run(ctx) })
+		r.observers = append(r.observers, r.nodeHealth)
+	}
+	if len(actions) > 0 {
+		reactor := newFailedDeviceReactor(logs.For(subsystemHealth), client, recorder, r.pods, cfg.ResourcePrefix, actions, cfg.MaxEvictions, cfg.EvictionInterval)
+		r.background.Go(func() { reactor.Run(ctx) })
+		r.observers = append(r.observers, reactor)
+	}
+	if cfg.ModuleAnnotations {
+		annotator := newModuleAnnotator(log, client, cfg.NodeName, cfg.ResourcePrefix, r.pods, cfg.PodResourcesInterval)
+		r.background.Go(func() { annotator.Run(ctx) })
+		r.observers = append(r.observers, annotator)
+	}
+	if cfg.NodeResourceTopology {
+		exporter := newTopologyExporter(log, dynamicClient, cfg.NodeName, cfg.TopologyManagerPolicy, cfg.TopologyManagerScope, r.pods, cfg.PodResourcesInterval, cfg.HostPath(numaNodesPath))
+		r.background.Go(func() { exporter.Run(ctx) })
+		r.observers = append(r.observers, exporter)
+	}
+	if cfg.DeviceObjects {
+		reporter := newDeviceStatusReporter(logs.For(subsystemHealth), dynamicClient, client, cfg.NodeName, r.pods, cfg.PodResourcesInterval)
+		r.background.Go(func() { reporter.Run(ctx) })
+		r.observers = append(r.observers, reporter)
+	}
+	return r, nil
+}
+
+// DevicesChanged tells every observer about devs.
+func (r *reporting) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	for _, o := range r.observers {
+		o.DevicesChanged(features, devs)
+	}
+}
+
+// DeviceFailed tells every observer interested why the device id failed.
+func (r *reporting) DeviceFailed(id, reason string) {
+	for _, o := range r.observers {
+		if o, ok := o.(failureObserver); ok {
+			o.DeviceFailed(id, reason)
+		}
+	}
+}
+
+// Reconfigure applies the reporting settings of cfg that may change while
+// the reporting runs.
+func (r *reporting) Reconfigure(cfg *Config) {
+	if r.nodeHealth != nil {
+		r.nodeHealth.SetThreshold(cfg.UnhealthyThreshold)
+	}
+}
+
+// Stop waits for the goroutines of the reporting, once the context it was
+// started with is done, and releases its resources.
+func (r *reporting) Stop() {
+	r.background.Wait()
+	for _, stop := range r.stop {
+		stop()
+	}
+}
@@ -21,12 +21,21 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -34,17 +43,69 @@ import (
 
 // HabanalabsDevicePlugin implements the Kubernetes device plugin API
 type HabanalabsDevicePlugin struct {
+	pluginapi.UnimplementedDevicePluginServer
 	ResourceManager
-	log          *slog.Logger
-	stop         chan interface{}
-	health       chan *pluginapi.Device
-	server       *grpc.Server
+	log       *slog.Logger
+	grpcLog   *slog.Logger
+	healthLog *slog.Logger
+	health    chan deviceFailure
+	server    *grpc.Server
+	// cancel ends the current serving cycle, whose goroutines run in group.
+	// done is closed when the cycle ends, by Stop or by a failing goroutine.
+	cancel context.CancelFunc
+	group  *errgroup.Group
+	done   <-chan struct{}
+	// draining is closed by Shutdown to end the ListAndWatch streams, which
+	// would otherwise keep a graceful stop waiting.
+	draining     chan struct{}
 	resourceName string
 	socket       string
-	devs         []*pluginapi.Device
+	// registrationSocket serves the plugin registration service in
+	// pluginwatcher mode, and registration receives kubelet's verdict.
+	registrationSocket string
+	registration       chan registrationStatus
+	cfg                atomic.Pointer[Config]
+	observers          []deviceObserver
+
+	// reconfigured tells watchDevices that the configuration changed.
+	reconfigured chan struct{}
+
+	// mu guards unhealthy, all, devs, features and streams. unhealthy holds
+	// the devices reported unhealthy, which stay so when they are discovered
+	// again, as a restart doesn't repair them. all holds every device
+	// discovered and devs those advertised, selected by the allow and deny
+	// lists. They are replaced, never modified, when a device changes, so a
+	// slice read under mu may be used after releasing it.
+	mu        sync.Mutex
+	unhealthy map[string]bool
+	all       []*pluginapi.Device
+	devs      []*pluginapi.Device
+	// features are exported to Node Feature Discovery and observers along
+	// with devs.
+	features nodeFeatures
+	// streams receive the devices of the ListAndWatch streams when they
+	// change. They only hold the latest devices.
+	streams map[chan []*pluginapi.Device]struct{}
+	// pods tells which containers use the devices, when known.
+	pods *podResources
+	// featuresPath is the directory the features were last exported to. It
+	// is only used by the goroutine telling about device changes.
+	featuresPath string
 }
 
-var devicePath = prefix + "/dev/accel"
+// deviceObserver is told about the devices the plugin serves when they are
+// discovered and whenever their health changes. DevicesChanged must not
+// block, and is handed a copy of the devices it may keep.
+type deviceObserver interface {
+	DevicesChanged(features nodeFeatures, devs []*pluginapi.Device)
+}
+
+// failureObserver is a deviceObserver also told why the health check marks
+// a device unhealthy, before the observers see the device change.
+// DeviceFailed must not block.
+type failureObserver interface {
+	DeviceFailed(id, reason string)
+}
 
 // GetPreferredAllocation returns a preferred set of devices to allocate
 // from a list of available ones. The resulting preferred allocation is not
@@ -57,18 +118,40 @@ func (m *HabanalabsDevicePlugin) GetPreferredAllocation(ctx context.Context, req
 }
 
 // NewHabanalabsDevicePlugin returns an initialized HabanalabsDevicePlugin.
-func NewHabanalabsDevicePlugin(log *slog.Logger, resourceManager ResourceManager, resourceName string, socket string) *HabanalabsDevicePlugin {
-	return &HabanalabsDevicePlugin{
-		log:             log,
+func NewHabanalabsDevicePlugin(logs *logging, resourceManager ResourceManager, resourceName string, socket, registrationSocket string, cfg *Config) *HabanalabsDevicePlugin {
+	m := &HabanalabsDevicePlugin{
+		log:             logs.Logger(),
+		grpcLog:         logs.For(subsystemGRPC),
+		healthLog:       logs.For(subsystemHealth),
 		ResourceManager: resourceManager,
 		resourceName:    resourceName,
 		socket:          socket,
 
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+		registrationSocket: registrationSocket,
+		registration:       make(chan registrationStatus),
+
+		health:       make(chan deviceFailure),
+		reconfigured: make(chan struct{}, 1),
+		unhealthy:    make(map[string]bool),
+		streams:      make(map[chan []*pluginapi.Device]struct{}),
+	}
+	m.cfg.Store(cfg)
+	return m
+}
+
+// config returns the configuration currently in effect.
+func (m *HabanalabsDevicePlugin) config() *Config {
+	return m.cfg.Load()
+}
 
-		// will be initialized on every server restart.
-		devs: nil,
+// Reconfigure applies cfg to the running plugin. The resource name and
+// socket are fixed for the lifetime of the plugin and are not affected.
+// Changes to the devices advertised reach kubelet through ListAndWatch.
+func (m *HabanalabsDevicePlugin) Reconfigure(cfg *Config) {
+	m.cfg.Store(cfg)
+	select {
+	case m.reconfigured <- struct{}{}:
+	default:
 	}
 }
 
@@ -97,20 +180,17 @@ func dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error
 	return c, nil
 }
 
-// Start starts the gRPC server of the device plugin
-func (m *HabanalabsDevicePlugin) Start() error {
+// Start starts the gRPC server of the device plugin, the health check and,
+// in pluginwatcher mode, the registration service. They run until Stop is
+// called, ctx is canceled or one of them fails.
+func (m *HabanalabsDevicePlugin) Start(ctx context.Context) error {
 	err := m.cleanup()
 	if err != nil {
 		return err
 	}
 
-	if m.stop == nil {
-		m.stop = make(chan interface{})
-	}
-
 	//  initialize Devices
-	m.devs, err = m.Devices()
-	if err != nil {
+	if err := m.loadDevices(ctx); err != nil {
 		return err
 	}
 
@@ -119,44 +199,349 @@ func (m *HabanalabsDevicePlugin) Start() error {
 		return err
 	}
 
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.group, ctx = errgroup.WithContext(ctx)
+	m.done = ctx.Done()
+	m.draining = make(chan struct{})
+
 	// First start serving the gRPC connection before registering.
 	// It is required since kubernetes 1.26. Change is backward compatible.
-	m.server = grpc.NewServer([]grpc.ServerOption{}...)
+	// Every kubelet call gets a server span; HLML calls made while serving
+	// it are recorded as child spans.
+	opts := append(serverInterceptors(m.grpcLog), grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	m.server = grpc.NewServer(opts...)
 	pluginapi.RegisterDevicePluginServer(m.server, m)
 
-	// Ignore error returns since the next block will fail if Serve fails.
-	go func() { _ = m.server.Serve(sock) }()
+	server := m.server
+	m.group.Go(func() error {
+		// Serve only returns nil once the server is stopped.
+		if err := server.Serve(sock); err != nil {
+			return fmt.Errorf("gRPC server failed: %w", err)
+		}
+		return nil
+	})
+	m.group.Go(func() error {
+		<-ctx.Done()
+		server.Stop()
+		return nil
+	})
 
 	// Wait for server to start by launching a blocking connection
-	conn, err := dial(m.socket, 5*time.Second)
+	conn, err := dial(m.socket, m.config().KubeletDialTimeout)
 	if err != nil {
+		_ = m.Stop()
 		return err
 	}
 	conn.Close()
 
-	go m.healthcheck()
+	// Devices left out by the allow and deny lists are watched too, they
+	// may be advertised again.
+	m.mu.Lock()
+	all := m.all
+	m.mu.Unlock()
+	m.group.Go(func() error {
+		watchXIDs(ctx, m.healthLog, all, m.health, m.config)
+		return nil
+	})
 
+	if m.config().RegistrationMode == registrationModePluginWatcher {
+		if err := m.startRegistrationServer(ctx); err != nil {
+			_ = m.Stop()
+			return fmt.Errorf("could not serve plugin registration: %w", err)
+		}
+	}
+
+	m.devicesChanged()
+	m.group.Go(func() error {
+		m.watchDevices(ctx)
+		return nil
+	})
 	return nil
 }
 
-// Stop gRPC server
+// Observe adds observers told about the devices the plugin serves.
+func (m *HabanalabsDevicePlugin) Observe(observers ...deviceObserver) {
+	m.observers = append(m.observers, observers...)
+}
+
+// CarryUnhealthy marks the devices ids unhealthy, e.g. those reported so
+// before the plugin restarted, for as long as they are discovered.
+func (m *HabanalabsDevicePlugin) CarryUnhealthy(ids ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		m.unhealthy[id] = true
+	}
+}
+
+// Unhealthy returns the devices reported unhealthy.
+func (m *HabanalabsDevicePlugin) Unhealthy() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Sorted(maps.Keys(m.unhealthy))
+}
+
+// UsePodResources makes the plugin log which containers use the devices,
+// from pods. pods may be nil.
+func (m *HabanalabsDevicePlugin) UsePodResources(pods *podResources) {
+	m.pods = pods
+}
+
+// devices returns the devices served. They must not be modified.
+func (m *HabanalabsDevicePlugin) devices() []*pluginapi.Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.devs
+}
+
+// setHealth sets the health of the device id, reporting whether it
+// changed and whether the device is advertised.
+func (m *HabanalabsDevicePlugin) setHealth(id, health string) (changed, advertised bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.all, func(d *pluginapi.Device) bool { return d.ID == id })
+	if i < 0 || m.all[i].Health == health {
+		return false, false
+	}
+	old := m.all[i]
+	d := &pluginapi.Device{ID: id, Health: health, Topology: old.Topology}
+	if health == pluginapi.Healthy {
+		delete(m.unhealthy, id)
+	} else {
+		m.unhealthy[id] = true
+	}
+	m.all = slices.Clone(m.all)
+	m.all[i] = d
+	j := slices.Index(m.devs, old)
+	if j >= 0 {
+		m.devs = slices.Clone(m.devs)
+		m.devs[j] = d
+	}
+	return true, j >= 0
+}
+
+// applyFilter selects the devices advertised out of all those discovered
+// with the allow and deny lists in effect, reporting whether they changed.
+func (m *HabanalabsDevicePlugin) applyFilter() bool {
+	filter, err := newDeviceFilter(m.config())
+	if err != nil {
+		// The lists are validated when the configuration is loaded.
+		m.log.Error("Invalid device filter, keeping the devices advertised", "error", err)
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var devs []*pluginapi.Device
+	for _, d := range m.all {
+		if filter.allows(d.ID, m.features.moduleIDs) {
+			devs = append(devs, d)
+		}
+	}
+	if slices.Equal(devs, m.devs) {
+		return false
+	}
+	m.devs = devs
+	return true
+}
+
+// watchDevices marks the devices reported by the health check unhealthy
+// and applies the allow and deny lists when the configuration changes,
+// until ctx is done, telling the ListAndWatch streams and the observers.
+// Devices change health whether kubelet is watching them or not.
+func (m *HabanalabsDevicePlugin) watchDevices(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-m.health:
+			id := f.dev.ID
+			changed, advertised := m.setHealth(id, pluginapi.Unhealthy)
+			if !changed {
+				continue
+			}
+			m.healthLog.Info("Device is unhealthy", "resource", m.resourceName, "id", id, "reason", f.reason, "advertised", advertised, "used_by", m.pods.Users(id))
+			for _, o := range m.observers {
+				if o, ok := o.(failureObserver); ok {
+					o.DeviceFailed(id, f.reason)
+				}
+			}
+			if advertised {
+				m.devicesChanged()
+			}
+		case <-m.reconfigured:
+			if m.applyFilter() {
+				m.log.Info("Devices advertised changed", "resource", m.resourceName, "count", len(m.devices()))
+				m.devicesChanged()
+				continue
+			}
+			// The features directory may have changed.
+			m.mu.Lock()
+			features, devs := m.features, m.devs
+			m.mu.Unlock()
+			m.exportFeatures(features, devs)
+		}
+	}
+}
+
+// devicesChanged sends the devices served to the ListAndWatch streams,
+// exports their features and tells the observers.
+func (m *HabanalabsDevicePlugin) devicesChanged() {
+	m.mu.Lock()
+	devs, features := m.devs, m.features
+	for stream := range m.streams {
+		// Replace the devices the stream didn't send yet.
+		select {
+		case <-stream:
+		default:
+		}
+		stream <- devs
+	}
+	m.mu.Unlock()
+
+	m.exportFeatures(features, devs)
+	for _, o := range m.observers {
+		copies := make([]*pluginapi.Device, len(devs))
+		for i, d := range devs {
+			copies[i] = &pluginapi.Device{ID: d.ID, Health: d.Health, Topology: d.Topology}
+		}
+		o.DevicesChanged(features, copies)
+	}
+}
+
+// exportFeatures writes the Node Feature Discovery feature file from the
+// devices served and their health, removing the one of the previous
+// directory when it changed. Failing to write the file is only logged, the
+// labels are not worth failing the plugin for.
+func (m *HabanalabsDevicePlugin) exportFeatures(features nodeFeatures, devs []*pluginapi.Device) {
+	cfg := m.config()
+	if cfg.NFDFeaturesPath != m.featuresPath {
+		if err := removeNodeFeatures(m.featuresPath); err != nil {
+			m.log.Warn("Failed removing device features", "error", err)
+		}
+		m.featuresPath = cfg.NFDFeaturesPath
+	}
+	if cfg.NFDFeaturesPath == "" {
+		return
+	}
+	if err := writeNodeFeatures(cfg.NFDFeaturesPath, features.labels(cfg.ResourcePrefix, devs)); err != nil {
+		m.log.Warn("Failed exporting device features", "error", err)
+	}
+}
+
+// subscribe returns the devices served and a channel receiving them when
+// they change, until unsubscribe is called.
+func (m *HabanalabsDevicePlugin) subscribe() ([]*pluginapi.Device, chan []*pluginapi.Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stream := make(chan []*pluginapi.Device, 1)
+	m.streams[stream] = struct{}{}
+	return m.devs, stream
+}
+
+func (m *HabanalabsDevicePlugin) unsubscribe(stream chan []*pluginapi.Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, stream)
+}
+
+// RegistrationStatus returns the channel on which kubelet's registration
+// verdicts are delivered in pluginwatcher mode.
+func (m *HabanalabsDevicePlugin) RegistrationStatus() <-chan registrationStatus {
+	return m.registration
+}
+
+// Done returns a channel that is closed when the plugin stops serving,
+// either because Stop was called or because serving failed. Stop then
+// returns the error. It is nil while the plugin is not started.
+func (m *HabanalabsDevicePlugin) Done() <-chan struct{} {
+	return m.done
+}
+
+// loadDevices discovers the devices and their features, and selects those
+// the plugin advertises and allocates. Devices reported unhealthy before
+// stay so, the others are forgotten.
+func (m *HabanalabsDevicePlugin) loadDevices(ctx context.Context) error {
+	devs, err := m.Devices(ctx)
+	if err != nil {
+		return err
+	}
+	features := detectNodeFeatures(m.log)
+	features.resourceName = m.resourceName
+	features.moduleIDs = detectModuleIDs(m.log, devs)
+
+	m.mu.Lock()
+	unhealthy := make(map[string]bool)
+	for i, d := range devs {
+		if m.unhealthy[d.ID] {
+			devs[i] = &pluginapi.Device{ID: d.ID, Health: pluginapi.Unhealthy, Topology: d.Topology}
+			unhealthy[d.ID] = true
+		}
+	}
+	m.unhealthy, m.all, m.devs, m.features = unhealthy, devs, nil, features
+	m.mu.Unlock()
+	if len(unhealthy) > 0 {
+		m.healthLog.Warn("Devices still unhealthy", "resource", m.resourceName, "ids", slices.Sorted(maps.Keys(unhealthy)))
+	}
+	m.applyFilter()
+	return nil
+}
+
+// Stop stops the gRPC server and waits for every goroutine of the plugin
+// to exit. It returns the error that made serving fail, if any.
 func (m *HabanalabsDevicePlugin) Stop() error {
 	if m.server == nil {
 		return nil
 	}
 
 	m.log.Info("Stoppping device plugin", "resource_name", m.resourceName, "socket", m.socket)
-	m.server.Stop()
-	m.server = nil
-	close(m.stop)
-	m.stop = nil
+	return m.wait()
+}
+
+// Shutdown stops the plugin gracefully: the server stops accepting RPCs
+// and in-flight ones are given until ctx is done to finish, before they are
+// aborted. The health check is stopped and the socket removed last, so
+// HLML may be shut down once Shutdown returns.
+func (m *HabanalabsDevicePlugin) Shutdown(ctx context.Context) error {
+	if m.server == nil {
+		return nil
+	}
 
-	return m.cleanup()
+	m.log.Info("Draining device plugin", "resource_name", m.resourceName, "socket", m.socket)
+	close(m.draining)
+
+	server := m.server
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		m.log.Warn("Timed out draining in-flight requests, aborting them")
+		server.Stop()
+		<-drained
+	}
+
+	return m.wait()
+}
+
+// wait stops the goroutines of the plugin, waits for them to exit and
+// removes the socket.
+func (m *HabanalabsDevicePlugin) wait() error {
+	m.cancel()
+	err := m.group.Wait()
+	m.server, m.cancel, m.group, m.done = nil, nil, nil, nil
+
+	return errors.Join(err, m.cleanup())
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
-func (m *HabanalabsDevicePlugin) Register() error {
-	conn, err := dial(pluginapi.KubeletSocket, 5*time.Second)
+func (m *HabanalabsDevicePlugin) Register(ctx context.Context) error {
+	cfg := m.config()
+	conn, err := dial(cfg.KubeletSocket(), cfg.KubeletDialTimeout)
 	if err != nil {
 		return err
 	}
@@ -169,7 +554,7 @@ func (m *HabanalabsDevicePlugin) Register() error {
 		ResourceName: m.resourceName,
 	}
 
-	_, err = client.Register(context.Background(), reqt)
+	_, err = client.Register(ctx, reqt)
 	if err != nil {
 		return err
 	}
@@ -178,107 +563,153 @@ func (m *HabanalabsDevicePlugin) Register() error {
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *HabanalabsDevicePlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	err := s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
+	log := loggerFromContext(s.Context(), m.grpcLog)
+	draining := m.draining
+	devs, stream := m.subscribe()
+	defer m.unsubscribe(stream)
+	err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs})
 	if err != nil {
 		return err
 	}
 
 	for {
 		select {
-		case <-m.stop:
+		case <-s.Context().Done():
+			// Canceled when kubelet disconnects or the server is stopped.
 			return nil
-		case d := <-m.health:
-			d.Health = pluginapi.Unhealthy
-			m.log.Info("Device is unhealthy", "resource", m.resourceName, "id", d.ID)
-			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs}); err != nil {
-				m.log.Error("Failed sending ListAndWatch to kubelet", "error", err)
+		case <-draining:
+			return nil
+		case devs := <-stream:
+			if err := s.Send(&pluginapi.ListAndWatchResponse{Devices: devs}); err != nil {
+				log.Error("Failed sending ListAndWatch to kubelet", "error", err)
 			}
 		}
 	}
 }
 
-func (m *HabanalabsDevicePlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
-}
-
 // Allocate which return list of devices.
 func (m *HabanalabsDevicePlugin) Allocate(ctx context.Context, reqs *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	devs := m.devs
+	log := loggerFromContext(ctx, m.grpcLog)
+	cfg := m.config()
+	devs := m.devices()
 	response := pluginapi.AllocateResponse{ContainerResponses: []*pluginapi.ContainerAllocateResponse{}}
 	for _, req := range reqs.ContainerRequests {
-		var devicesList []*pluginapi.DeviceSpec
-		netConfig := make([]string, 0, len(req.DevicesIDs))
-		paths := make([]string, 0, len(req.DevicesIDs))
-		uuids := make([]string, 0, len(req.DevicesIDs))
-		visibleModule := make([]string, 0, len(req.DevicesIDs))
-
-		for _, id := range req.DevicesIDs {
-			device := getDevice(devs, id)
-			if device == nil {
-				return nil, fmt.Errorf("invalid request for %q: device unknown: %s", m.resourceName, id)
-			}
-			m.log.Info("Preparing device for registration", "device", device)
+		trace.SpanFromContext(ctx).AddEvent("container request", trace.WithAttributes(
+			attribute.StringSlice("device_ids", req.DevicesIds),
+		))
 
-			m.log.Info("Getting device handle from hlml")
-			deviceHandle, err := hlml.DeviceHandleBySerial(id)
-			if err != nil {
-				m.log.Error(err.Error())
-				return nil, err
-			}
-
-			m.log.Info("Getting device minor number")
-			minor, err := deviceHandle.MinorNumber()
-			if err != nil {
-				m.log.Error(err.Error())
-				return nil, err
-			}
-
-			m.log.Info("Getting device module id")
-			moduleID, err := deviceHandle.ModuleID()
-			if err != nil {
-				m.log.Error(err.Error())
-				return nil, err
-			}
+		resp, err := allocateContainer(ctx, log, cfg, m.resourceName, devs, req.DevicesIds)
+		if err != nil {
+			return nil, err
+		}
+		response.ContainerResponses = append(response.ContainerResponses, resp)
+	}
 
-			path := fmt.Sprintf(devicePath+"/accel%d", minor)
-			paths = append(paths, path)
-			uuids = append(uuids, id)
-			netConfig = append(netConfig, fmt.Sprintf("%d", minor))
-			visibleModule = append(visibleModule, fmt.Sprintf("%d", moduleID))
+	return &response, nil
+}
 
-			ds := &pluginapi.DeviceSpec{
-				ContainerPath: path,
-				HostPath:      path,
-				Permissions:   "rw",
-			}
-			devicesList = append(devicesList, ds)
-			path = fmt.Sprintf(devicePath+"/accel_controlD%d", minor)
+// allocateContainer returns the device nodes and environment giving a
+// container access to the devices ids, out of devs.
+func allocateContainer(ctx context.Context, log *slog.Logger, cfg *Config, resourceName string, devs []*pluginapi.Device, ids []string) (*pluginapi.ContainerAllocateResponse, error) {
+	var devicesList []*pluginapi.DeviceSpec
+	netConfig := make([]string, 0, len(ids))
+	paths := make([]string, 0, len(ids))
+	uuids := make([]string, 0, len(ids))
+	visibleModule := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		device := getDevice(devs, id)
+		if device == nil {
+			return nil, fmt.Errorf("invalid request for %q: device unknown: %s", resourceName, id)
+		}
+		log.Debug("Preparing device for registration", "device", device)
+
+		serialAttr := attribute.String("serial", id)
+
+		log.Debug("Getting device handle from hlml")
+		var deviceHandle *Device
+		err := traceHLML(ctx, "DeviceHandleBySerial", func() (err error) {
+			deviceHandle, err = hlml.DeviceHandleBySerial(id)
+			return err
+		}, serialAttr)
+		if err != nil {
+			return nil, err
+		}
 
-			ds = &pluginapi.DeviceSpec{
-				ContainerPath: path,
-				HostPath:      path,
-				Permissions:   "rw",
-			}
-			devicesList = append(devicesList, ds)
+		log.Debug("Getting device minor number")
+		var minor uint
+		err = traceHLML(ctx, "MinorNumber", func() (err error) {
+			minor, err = deviceHandle.MinorNumber()
+			return err
+		}, serialAttr)
+		if err != nil {
+			return nil, err
 		}
 
-		envMap := map[string]string{
-			"HABANA_VISIBLE_DEVICES":  strings.Join(netConfig, ","),
-			"HL_VISIBLE_DEVICES":      strings.Join(paths, ","),
-			"HL_VISIBLE_DEVICES_UUID": strings.Join(uuids, ","),
+		log.Debug("Getting device module id")
+		var moduleID uint
+		err = traceHLML(ctx, "ModuleID", func() (err error) {
+			moduleID, err = deviceHandle.ModuleID()
+			return err
+		}, serialAttr)
+		if err != nil {
+			return nil, err
 		}
 
-		if len(req.DevicesIDs) < len(m.devs) {
-			envMap["HABANA_VISIBLE_MODULES"] = strings.Join(visibleModule, ",")
+		// Device paths are host paths, kubelet resolves them on the host.
+		path := filepath.Join(cfg.DevicePath, fmt.Sprintf("accel%d", minor))
+		checkDeviceNode(log, cfg, path)
+		paths = append(paths, path)
+		uuids = append(uuids, id)
+		netConfig = append(netConfig, fmt.Sprintf("%d", minor))
+		visibleModule = append(visibleModule, fmt.Sprintf("%d", moduleID))
+
+		ds := &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      path,
+			Permissions:   "rw",
+		}
+		devicesList = append(devicesList, ds)
+		path = filepath.Join(cfg.DevicePath, fmt.Sprintf("accel_controlD%d", minor))
+		checkDeviceNode(log, cfg, path)
+
+		ds = &pluginapi.DeviceSpec{
+			ContainerPath: path,
+			HostPath:      path,
+			Permissions:   "rw",
 		}
+		devicesList = append(devicesList, ds)
+	}
 
-		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerAllocateResponse{
-			Devices: devicesList,
-			Envs:    envMap,
-		})
+	envMap := map[string]string{
+		"HABANA_VISIBLE_DEVICES":  strings.Join(netConfig, ","),
+		"HL_VISIBLE_DEVICES":      strings.Join(paths, ","),
+		"HL_VISIBLE_DEVICES_UUID": strings.Join(uuids, ","),
 	}
 
-	return &response, nil
+	if len(ids) < len(devs) {
+		envMap["HABANA_VISIBLE_MODULES"] = strings.Join(visibleModule, ",")
+	}
+
+	templates, err := parseEnvTemplates(cfg.AllocateEnv)
+	if err != nil {
+		return nil, err
+	}
+	err = renderEnvTemplates(templates, allocation{
+		Resource: resourceName,
+		Count:    len(ids),
+		Serials:  strings.Join(uuids, ","),
+		Modules:  strings.Join(visibleModule, ","),
+		Minors:   strings.Join(netConfig, ","),
+	}, envMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pluginapi.ContainerAllocateResponse{
+		Devices: devicesList,
+		Envs:    envMap,
+	}, nil
 }
 
 // PreStartContainer performs actions before the container start
@@ -286,40 +717,42 @@ func (m *HabanalabsDevicePlugin) PreStartContainer(context.Context, *pluginapi.P
 	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
+// checkDeviceNode warns when the device node at the host path p can't be
+// found through the host root, as kubelet would then fail to create the
+// container.
+func checkDeviceNode(log *slog.Logger, cfg *Config, p string) {
+	if _, err := os.Stat(cfg.HostPath(p)); err != nil {
+		log.Warn("Device node not found on host", "path", p, "host_root", cfg.HostRoot, "error", err)
+	}
+}
+
 func (m *HabanalabsDevicePlugin) cleanup() error {
 	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if err := os.Remove(m.registrationSocket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
 	return nil
 }
 
-func (m *HabanalabsDevicePlugin) healthcheck() {
-	ctx, cancel := context.WithCancel(context.Background())
-
-	xids := make(chan *pluginapi.Device)
-	go watchXIDs(ctx, m.devs, xids)
-
-	for {
-		select {
-		case <-m.stop:
-			cancel()
-			return
-		case dev := <-xids:
-			m.unhealthy(dev)
-		}
-	}
-}
-
-// Serve starts the gRPC server and register the device plugin to Kubelet
-func (m *HabanalabsDevicePlugin) Serve() error {
-	err := m.Start()
+// Serve starts the gRPC server and register the device plugin to Kubelet.
+// In pluginwatcher mode kubelet discovers the plugin instead, and its
+// verdict is reported on RegistrationStatus.
+func (m *HabanalabsDevicePlugin) Serve(ctx context.Context) error {
+	err := m.Start(ctx)
 	if err != nil {
 		return fmt.Errorf("could not start device plugln: %w", err)
 	}
 	m.log.Info("Starting to serve", "socket", m.socket)
 
-	err = m.Register()
+	if m.config().RegistrationMode == registrationModePluginWatcher {
+		m.log.Info("Waiting for kubelet to discover the device plugin", "registration_socket", m.registrationSocket)
+		return nil
+	}
+
+	err = m.Register(ctx)
 	if err != nil {
 		_ = m.Stop()
 		return fmt.Errorf("could not register device plugin: %w", err)
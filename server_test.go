@@ -0,0 +1,409 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// startTestPlugin starts a device plugin serving the fake HLML devices on
+// a socket in a temporary directory, telling observers, and returns it
+// with a client connection to it.
+func startTestPlugin(t *testing.T, observers ...deviceObserver) (*HabanalabsDevicePlugin, *grpc.ClientConn) {
+	t.Helper()
+	hlml = getHlml()
+
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.NFDFeaturesPath = ""
+	cfg.PCIDevicesPath = t.TempDir()
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "habanalabs.sock")
+
+	m := NewHabanalabsDevicePlugin(logs, NewDeviceManager(logs.Logger(), "gaudi"), "habana.ai/gaudi", socket, filepath.Join(dir, "reg.sock"), cfg)
+	m.Observe(observers...)
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	t.Cleanup(func() { _ = m.Stop() })
+
+	conn, err := dial(socket, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return m, conn
+}
+
+// recordingObserver records the devices it is told about.
+type recordingObserver struct {
+	mu      sync.Mutex
+	changes [][]*pluginapi.Device
+}
+
+func (o *recordingObserver) DevicesChanged(_ nodeFeatures, devs []*pluginapi.Device) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.changes = append(o.changes, devs)
+}
+
+// waitChanges waits for the observer to be told about n changes and
+// returns them.
+func (o *recordingObserver) waitChanges(t *testing.T, n int) [][]*pluginapi.Device {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o.mu.Lock()
+		changes := o.changes
+		o.mu.Unlock()
+		if len(changes) >= n {
+			return changes
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("observer told about %d changes, want %d", len(changes), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// healthOf returns the health of the device id among devs.
+func healthOf(devs []*pluginapi.Device, id string) string {
+	if d := getDevice(devs, id); d != nil {
+		return d.Health
+	}
+	return ""
+}
+
+func TestHealthFanOut(t *testing.T) {
+	observer := &recordingObserver{}
+	m, conn := startTestPlugin(t, observer)
+	client := pluginapi.NewDevicePluginClient(conn)
+	devs := m.devices()
+	first, second := devs[0].ID, devs[1].ID
+
+	// Health reaches the observers without kubelet watching.
+	m.health <- deviceFailure{dev: &pluginapi.Device{ID: first}, reason: "test"}
+	changes := observer.waitChanges(t, 2)
+	if h := healthOf(changes[1], first); h != pluginapi.Unhealthy {
+		t.Fatalf("observed health of %s = %q, want Unhealthy", first, h)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var streams []pluginapi.DevicePlugin_ListAndWatchClient
+	for range 2 {
+		stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := healthOf(resp.Devices, first); h != pluginapi.Unhealthy {
+			t.Fatalf("listed health of %s = %q, want Unhealthy", first, h)
+		}
+		streams = append(streams, stream)
+	}
+
+	// Allocate reads the devices while their health changes.
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for range 20 {
+			_, err := client.Allocate(ctx, &pluginapi.AllocateRequest{
+				ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIds: []string{second}}},
+			})
+			if err != nil {
+				t.Errorf("Allocate() = %v", err)
+				return
+			}
+		}
+	})
+	// A device already unhealthy is not reported again.
+	m.health <- deviceFailure{dev: &pluginapi.Device{ID: first}, reason: "test"}
+	m.health <- deviceFailure{dev: &pluginapi.Device{ID: second}, reason: "test"}
+	wg.Wait()
+
+	// Every stream gets the change, not only the one receiving it first.
+	for i, stream := range streams {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := healthOf(resp.Devices, second); h != pluginapi.Unhealthy {
+			t.Errorf("stream %d health of %s = %q, want Unhealthy", i, second, h)
+		}
+	}
+	changes = observer.waitChanges(t, 3)
+	if len(changes) != 3 {
+		t.Errorf("observer told about %d changes, want 3", len(changes))
+	}
+	if h := healthOf(changes[0], first); h != pluginapi.Healthy {
+		t.Errorf("devices handed to observers were modified, health of %s = %q", first, h)
+	}
+}
+
+func TestReconfigureDevices(t *testing.T) {
+	observer := &recordingObserver{}
+	m, conn := startTestPlugin(t, observer)
+	client := pluginapi.NewDevicePluginClient(conn)
+	all := m.devices()
+	first, second := all[0].ID, all[1].ID
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ListAndWatch(ctx, &pluginapi.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || len(resp.Devices) != len(all) {
+		t.Fatalf("listed %v, %v, want %d devices", resp, err, len(all))
+	}
+
+	// Module 1 is the second device of the fake HLML.
+	cfg := *m.config()
+	cfg.DeviceDenyList = first + ",1"
+	cfg.AllocateEnv = "HABANA_LOGS=/var/log/habana_logs/{{.Modules}},DEVICES={{.Count}}"
+	m.Reconfigure(&cfg)
+
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Devices) != len(all)-2 || getDevice(resp.Devices, first) != nil || getDevice(resp.Devices, second) != nil {
+		t.Errorf("listed %d devices after denying %s and module 1", len(resp.Devices), first)
+	}
+	if changes := observer.waitChanges(t, 2); len(changes[1]) != len(all)-2 {
+		t.Errorf("observer told about %d devices, want %d", len(changes[1]), len(all)-2)
+	}
+
+	_, err = client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIds: []string{first}}},
+	})
+	if err == nil {
+		t.Error("allocating a denied device succeeded")
+	}
+	third := resp.Devices[0].ID
+	alloc, err := client.Allocate(ctx, &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIds: []string{third}}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate() = %v", err)
+	}
+	env := alloc.ContainerResponses[0].Envs
+	if env["HABANA_LOGS"] != "/var/log/habana_logs/"+env["HABANA_VISIBLE_MODULES"] || env["DEVICES"] != "1" {
+		t.Errorf("Allocate env = %v", env)
+	}
+
+	// A denied device turning unhealthy isn't advertised again.
+	m.health <- deviceFailure{dev: &pluginapi.Device{ID: first}, reason: "test"}
+	cfg.DeviceDenyList = ""
+	m.Reconfigure(&cfg)
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Devices) != len(all) || healthOf(resp.Devices, first) != pluginapi.Unhealthy {
+		t.Errorf("listed %d devices, health of %s %q, after clearing the deny list", len(resp.Devices), first, healthOf(resp.Devices, first))
+	}
+}
+
+func TestReconfigureFeaturesPath(t *testing.T) {
+	m, _ := startTestPlugin(t)
+	old, moved := t.TempDir(), t.TempDir()
+	cfg := *m.config()
+	cfg.NFDFeaturesPath = old
+	m.Reconfigure(&cfg)
+	waitFile(t, filepath.Join(old, nfdFeatureFile), true)
+
+	next := cfg
+	next.NFDFeaturesPath = moved
+	m.Reconfigure(&next)
+	waitFile(t, filepath.Join(moved, nfdFeatureFile), true)
+	waitFile(t, filepath.Join(old, nfdFeatureFile), false)
+	select {
+	case <-m.Done():
+		t.Error("plugin stopped after moving the features")
+	default:
+	}
+}
+
+// waitFile waits for the file at path to exist or not.
+func waitFile(t *testing.T, path string, exists bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(path)
+		if (err == nil) == exists {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s exists: %t, want %t", path, err == nil, exists)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnhealthyAcrossRestarts(t *testing.T) {
+	observer := &recordingObserver{}
+	m, _ := startTestPlugin(t, observer)
+	devs := m.devices()
+	first := devs[0].ID
+	m.health <- deviceFailure{dev: &pluginapi.Device{ID: first}, reason: "test"}
+	observer.waitChanges(t, 2)
+
+	// Restarting, e.g. when kubelet restarts, discovers the devices again.
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	changes := observer.waitChanges(t, 3)
+	if h := healthOf(changes[2], first); h != pluginapi.Unhealthy {
+		t.Errorf("health of %s after restart = %q, want Unhealthy", first, h)
+	}
+	if got := m.Unhealthy(); len(got) != 1 || got[0] != first {
+		t.Errorf("Unhealthy() = %v, want %s", got, first)
+	}
+
+	// A new plugin carries them over, devices no longer present are
+	// forgotten. The first one must stop before HLML is replaced.
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := startTestPlugin(t)
+	_ = next.Stop()
+	carried := next.devices()[1].ID
+	next.CarryUnhealthy("gone", carried)
+	if err := next.Start(context.Background()); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	if got := next.Unhealthy(); len(got) != 1 || got[0] != carried {
+		t.Errorf("Unhealthy() = %v, want %s", got, carried)
+	}
+	if h := healthOf(next.devices(), carried); h != pluginapi.Unhealthy {
+		t.Errorf("health of carried device = %q, want Unhealthy", h)
+	}
+}
+
+// panickingPlugin is a device plugin whose Allocate panics.
+type panickingPlugin struct {
+	pluginapi.UnimplementedDevicePluginServer
+}
+
+func (panickingPlugin) Allocate(context.Context, *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
+	panic("allocate exploded")
+}
+
+func TestInterceptorsRecoverPanic(t *testing.T) {
+	var buf syncBuffer
+	logs, err := newLogging(&buf, logFormatJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "panic.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(serverInterceptors(logs.Logger())...)
+	pluginapi.RegisterDevicePluginServer(server, panickingPlugin{})
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	conn, err := dial(socket, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	const method = "/v1beta1.DevicePlugin/Allocate"
+	panics := testutil.ToFloat64(grpcPanicsTotal.WithLabelValues(method))
+	internal := testutil.ToFloat64(grpcRequestsTotal.WithLabelValues(method, codes.Internal.String()))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), correlationIDKey, "req-42")
+	_, err = pluginapi.NewDevicePluginClient(conn).Allocate(ctx, &pluginapi.AllocateRequest{})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Allocate() = %v, want an Internal error", err)
+	}
+
+	// The server keeps serving after the panic.
+	_, err = pluginapi.NewDevicePluginClient(conn).GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("GetDevicePluginOptions() = %v, want Unimplemented", err)
+	}
+
+	if got := testutil.ToFloat64(grpcPanicsTotal.WithLabelValues(method)) - panics; got != 1 {
+		t.Errorf("%v panics recorded, want 1", got)
+	}
+	if got := testutil.ToFloat64(grpcRequestsTotal.WithLabelValues(method, codes.Internal.String())) - internal; got != 1 {
+		t.Errorf("%v Internal requests recorded, want 1", got)
+	}
+
+	var recovered bool
+	for line := range strings.Lines(buf.String()) {
+		if strings.Contains(line, "Recovered from panic in gRPC handler") {
+			recovered = true
+			if !strings.Contains(line, `"correlation_id":"req-42"`) || !strings.Contains(line, `"method":"`+method+`"`) {
+				t.Errorf("panic log %s misses the method or correlation ID", line)
+			}
+		}
+	}
+	if !recovered {
+		t.Errorf("no panic logged in %s", buf.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// nodeResourceTopologyResource is the NodeResourceTopology custom resource
+// read by the topology-aware scheduler plugins.
+var nodeResourceTopologyResource = schema.GroupVersionResource{
+	Group:    "topology.node.k8s.io",
+	Version:  "v1alpha2",
+	Resource: "noderesourcetopologies",
+}
+
+// numaNodesPath is the sysfs directory of NUMA nodes, relative to the host
+// root.
+const numaNodesPath = "/sys/devices/system/node"
+
+// Topology manager policies and scopes, as configured on kubelet.
+var (
+	topologyManagerPolicies = []string{"none", "best-effort", "restricted", "single-numa-node"}
+	topologyManagerScopes   = []string{"container", "pod"}
+)
+
+// topologyZone counts the devices of a NUMA node.
+type topologyZone struct {
+	numaNode int64
+	// capacity counts every device, allocatable the healthy ones kubelet
+	// may allocate and available those of them not assigned to containers.
+	capacity, allocatable, available int
+}
+
+// nodeTopology is the NUMA topology of the node's devices.
+type nodeTopology struct {
+	resourceName string
+	zones        []topologyZone
+}
+
+func (t nodeTopology) equal(o nodeTopology) bool {
+	return t.resourceName == o.resourceName && slices.Equal(t.zones, o.zones)
+}
+
+// topologyExporter publishes the NUMA topology of the node's devices, and
+// how many of them are available, as a NodeResourceTopology named after
+// the node. Devices without NUMA affinity are left out. As assignments
+// change without the devices changing, the topology is refreshed every
+// interval too. Updates are applied in the background by Run.
+type topologyExporter struct {
+	log      *slog.Logger
+	client   dynamic.Interface
+	nodeName string
+	policy   string
+	scope    string
+	pods     *podResources
+	interval time.Duration
+	updates  *latestUpdate[nodeTopology]
+	// nodesPath is the sysfs directory the NUMA distances are read from.
+	nodesPath string
+
+	mu           sync.Mutex
+	resourceName string
+	devs         []*pluginapi.Device
+	// last is the topology last handed to updates.
+	last *nodeTopology
+}
+
+func newTopologyExporter(log *slog.Logger, client dynamic.Interface, nodeName, policy, scope string, pods *podResources, interval time.Duration, nodesPath string) *topologyExporter {
+	return &topologyExporter{
+		log:       log,
+		client:    client,
+		nodeName:  nodeName,
+		policy:    policy,
+		scope:     scope,
+		pods:      pods,
+		interval:  interval,
+		updates:   newLatestUpdate[nodeTopology](),
+		nodesPath: nodesPath,
+	}
+}
+
+// DevicesChanged schedules publishing the topology of devs.
+func (e *topologyExporter) DevicesChanged(features nodeFeatures, devs []*pluginapi.Device) {
+	e.mu.Lock()
+	e.resourceName, e.devs = features.resourceName, devs
+	e.mu.Unlock()
+	e.refresh()
+}
+
+// Run publishes the topology until ctx is done.
+func (e *topologyExporter) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Go(func() {
+		e.updates.Run(ctx, e.log.With("node", e.nodeName), "Failed publishing node resource topology, retrying", e.apply)
+	})
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.refresh()
+		}
+	}
+}
+
+// refresh schedules publishing the topology when it changed.
+func (e *topologyExporter) refresh() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t := nodeTopology{resourceName: e.resourceName}
+	for _, d := range e.devs {
+		if d.Topology == nil || len(d.Topology.Nodes) == 0 {
+			continue
+		}
+		numaNode := d.Topology.Nodes[0].ID
+		i := slices.IndexFunc(t.zones, func(z topologyZone) bool { return z.numaNode == numaNode })
+		if i < 0 {
+			t.zones = append(t.zones, topologyZone{numaNode: numaNode})
+			i = len(t.zones) - 1
+		}
+		z := &t.zones[i]
+		z.capacity++
+		if allocatable, ok := e.pods.Allocatable(d.ID); d.Health != pluginapi.Healthy || (ok && !allocatable) {
+			continue
+		}
+		z.allocatable++
+		if len(e.pods.Assignments(d.ID)) == 0 {
+			z.available++
+		}
+	}
+	slices.SortFunc(t.zones, func(a, b topologyZone) int { return cmp.Compare(a.numaNode, b.numaNode) })
+
+	if e.last != nil && e.last.equal(t) {
+		return
+	}
+	e.last = &t
+	e.updates.Set(t)
+}
+
+// apply creates or replaces the NodeResourceTopology of the node with t.
+// The plugin owns the object: zones it doesn't report are dropped.
+func (e *topologyExporter) apply(ctx context.Context, t nodeTopology) error {
+	client := e.client.Resource(nodeResourceTopologyResource)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(ctx, e.nodeName, metav1.GetOptions{})
+		create := apierrors.IsNotFound(err)
+		switch {
+		case create:
+			obj = &unstructured.Unstructured{}
+			obj.SetAPIVersion(nodeResourceTopologyResource.GroupVersion().String())
+			obj.SetKind("NodeResourceTopology")
+			obj.SetName(e.nodeName)
+		case err != nil:
+			return fmt.Errorf("failed getting node resource topology: %w", err)
+		}
+
+		obj.Object["zones"] = e.zones(t)
+		obj.Object["attributes"] = e.attributes()
+
+		if create {
+			_, err = client.Create(ctx, obj, metav1.CreateOptions{})
+		} else {
+			_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		e.log.Debug("Published node resource topology", "node", e.nodeName, "zones", len(t.zones))
+		return nil
+	})
+}
+
+// zones returns the zones of t as NodeResourceTopology zones, named
+// node-N like Node Feature Discovery's topology updater names them. Their
+// costs are the NUMA distances to every node, left out when unknown.
+func (e *topologyExporter) zones(t nodeTopology) []any {
+	distances, err := numaDistances(e.nodesPath)
+	if err != nil {
+		e.log.Debug("Failed reading NUMA distances, publishing zones without costs", "path", e.nodesPath, "error", err)
+	}
+	zones := make([]any, 0, len(t.zones))
+	for _, z := range t.zones {
+		zone := map[string]any{
+			"name": numaZoneName(z.numaNode),
+			"type": "Node",
+			"resources": []any{map[string]any{
+				"name":        t.resourceName,
+				"capacity":    strconv.Itoa(z.capacity),
+				"allocatable": strconv.Itoa(z.allocatable),
+				"available":   strconv.Itoa(z.available),
+			}},
+		}
+		if d, ok := distances[z.numaNode]; ok {
+			costs := make([]any, 0, len(d))
+			for _, to := range slices.Sorted(maps.Keys(d)) {
+				costs = append(costs, map[string]any{"name": numaZoneName(to), "value": d[to]})
+			}
+			zone["costs"] = costs
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+func numaZoneName(numaNode int64) string {
+	return "node-" + strconv.FormatInt(numaNode, 10)
+}
+
+// numaDistances reads the distances between the NUMA nodes from the sysfs
+// directory path, by node and then by the node distant from it. The
+// distance file of a node lists them in the order of the online nodes.
+func numaDistances(path string) (map[int64]map[int64]int64, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []int64
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), "node")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, id)
+	}
+	slices.Sort(nodes)
+
+	distances := make(map[int64]map[int64]int64, len(nodes))
+	for _, node := range nodes {
+		b, err := os.ReadFile(filepath.Join(path, "node"+strconv.FormatInt(node, 10), "distance"))
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) != len(nodes) {
+			return nil, fmt.Errorf("node %d has %d distances for %d nodes", node, len(fields), len(nodes))
+		}
+		distances[node] = make(map[int64]int64, len(nodes))
+		for i, f := range fields {
+			d, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("node %d: invalid distance %q", node, f)
+			}
+			distances[node][nodes[i]] = d
+		}
+	}
+	return distances, nil
+}
+
+// attributes returns the topology manager configuration of kubelet, for
+// the scheduler to know how it aligns resources.
+func (e *topologyExporter) attributes() []any {
+	attrs := []any{map[string]any{"name": "topologyManagerScope", "value": e.scope}}
+	if e.policy != "" {
+		attrs = append(attrs, map[string]any{"name": "topologyManagerPolicy", "value": e.policy})
+	}
+	return attrs
+}
@@ -0,0 +1,165 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// writeNUMADistances writes the sysfs distance files of two NUMA nodes
+// under a temporary directory and returns it.
+func writeNUMADistances(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"node0/distance": "10 21\n",
+		"node1/distance": "21 10\n",
+		"online":         "0-1\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestTopologyExporter(t *testing.T) {
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaudi := func(ids ...string) []*podresourcesapi.ContainerDevices {
+		return []*podresourcesapi.ContainerDevices{{ResourceName: "habana.ai/gaudi", DeviceIds: ids}}
+	}
+	socket := servePodResources(t, &fakePodResources{
+		pods: []*podresourcesapi.PodResources{{Name: "train", Namespace: "ml", Containers: []*podresourcesapi.ContainerResources{
+			{Name: "worker", Devices: gaudi("B")},
+		}}},
+		allocatable: gaudi("A", "B", "C", "D"),
+	})
+	pods := newPodResources(logs.Logger(), socket, filepath.Join(t.TempDir(), "checkpoint"), "habana.ai/", time.Second, time.Minute)
+	ctx := context.Background()
+	if err := pods.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		nodeResourceTopologyResource: "NodeResourceTopologyList",
+	})
+	e := newTopologyExporter(logs.Logger(), client, "node-1", "single-numa-node", "container", pods, time.Minute, writeNUMADistances(t))
+
+	// publish applies the topology the exporter scheduled for devs and
+	// returns the zones of the object.
+	publish := func(devs ...*pluginapi.Device) []any {
+		t.Helper()
+		e.DevicesChanged(nodeFeatures{resourceName: "habana.ai/gaudi"}, devs)
+		if err := e.apply(ctx, *e.last); err != nil {
+			t.Fatalf("apply() = %v", err)
+		}
+		obj, err := client.Resource(nodeResourceTopologyResource).Get(ctx, "node-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.GetKind() != "NodeResourceTopology" || obj.GetAPIVersion() != "topology.node.k8s.io/v1alpha2" {
+			t.Errorf("object is a %s %s", obj.GetAPIVersion(), obj.GetKind())
+		}
+		wantAttrs := []any{
+			map[string]any{"name": "topologyManagerScope", "value": "container"},
+			map[string]any{"name": "topologyManagerPolicy", "value": "single-numa-node"},
+		}
+		if !reflect.DeepEqual(obj.Object["attributes"], wantAttrs) {
+			t.Errorf("attributes = %v, want %v", obj.Object["attributes"], wantAttrs)
+		}
+		return obj.Object["zones"].([]any)
+	}
+	zone := func(name string, capacity, allocatable, available string, costs ...int64) any {
+		return map[string]any{
+			"name": name,
+			"type": "Node",
+			"resources": []any{map[string]any{
+				"name":        "habana.ai/gaudi",
+				"capacity":    capacity,
+				"allocatable": allocatable,
+				"available":   available,
+			}},
+			"costs": []any{
+				map[string]any{"name": "node-0", "value": costs[0]},
+				map[string]any{"name": "node-1", "value": costs[1]},
+			},
+		}
+	}
+
+	// B is assigned, C unhealthy and E without NUMA affinity.
+	zones := publish(
+		numaDevice("A", pluginapi.Healthy, 0),
+		numaDevice("B", pluginapi.Healthy, 0),
+		numaDevice("C", pluginapi.Unhealthy, 1),
+		numaDevice("D", pluginapi.Healthy, 1),
+		&pluginapi.Device{ID: "E", Health: pluginapi.Healthy},
+	)
+	want := []any{zone("node-0", "2", "2", "1", 10, 21), zone("node-1", "2", "1", "1", 21, 10)}
+	if !reflect.DeepEqual(zones, want) {
+		t.Errorf("zones = %v, want %v", zones, want)
+	}
+
+	// The devices of NUMA node 1 are gone: the object is updated and the
+	// zone dropped.
+	zones = publish(numaDevice("A", pluginapi.Healthy, 0), numaDevice("B", pluginapi.Healthy, 0))
+	want = want[:1]
+	if !reflect.DeepEqual(zones, want) {
+		t.Errorf("zones after an update = %v, want %v", zones, want)
+	}
+
+	var verbs []string
+	for _, a := range client.Actions() {
+		verbs = append(verbs, a.GetVerb())
+	}
+	if wantVerbs := []string{"get", "create", "get", "get", "update", "get"}; !slices.Equal(verbs, wantVerbs) {
+		t.Errorf("actions %v, want %v", verbs, wantVerbs)
+	}
+}
+
+func TestNUMADistancesMismatch(t *testing.T) {
+	dir := writeNUMADistances(t)
+	if err := os.WriteFile(filepath.Join(dir, "node1", "distance"), []byte("21\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := numaDistances(dir); err == nil {
+		t.Error("numaDistances() accepted a node missing distances")
+	}
+}
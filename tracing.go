@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the plugin's spans. The tracer is looked
+// up from the global provider on every use rather than once: a tracer
+// obtained before otel.SetTracerProvider only ever delegates to the first
+// provider installed, so later ones, as tests install, would be ignored.
+const tracerName = "github.com/HabanaAI/habanalabs-k8s-device-plugin"
+
+// initTracing configures the global tracer provider to export spans over
+// OTLP/gRPC to endpoint. Tracing stays disabled when endpoint is empty. The
+// returned function flushes pending spans and must be called on exit.
+func initTracing(ctx context.Context, log *slog.Logger, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		log.Info("Tracing disabled, no OTLP endpoint configured")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx,
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating OTLP trace exporter: %w", err)
+	}
+
+	tp := newTracerProvider(exporter)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	log.Info("Tracing enabled", "endpoint", endpoint)
+
+	return tp.Shutdown, nil
+}
+
+// newTracerProvider returns a tracer provider batching spans to exporter.
+// Tests pass an in-memory exporter.
+func newTracerProvider(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName("habana-device-plugin"),
+			semconv.ServiceVersion(build),
+		)),
+	)
+}
+
+// traceHLML runs fn, an HLML call, inside a child span of ctx named after op.
+func traceHLML(ctx context.Context, op string, fn func() error, attrs ...attribute.KeyValue) error {
+	_, span := otel.Tracer(tracerName).Start(ctx, "hlml."+op, trace.WithAttributes(attrs...))
+	defer span.End()
+
+	start := time.Now()
+	err := fn()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	hlmlLog.Debug("HLML call", "op", op, "duration", time.Since(start), "error", err)
+	return err
+}
@@ -0,0 +1,149 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// installTracerProvider installs a global tracer provider exporting to the
+// returned in-memory exporter for the duration of the test.
+func installTracerProvider(t *testing.T) (*tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(exporter)
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = tp.Shutdown(context.Background())
+	})
+	return exporter, tp
+}
+
+func TestAllocateSpans(t *testing.T) {
+	exporter, tp := installTracerProvider(t)
+
+	_, conn := startTestPlugin(t)
+	serial, err := simulatedDevices[0].SerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pluginapi.NewDevicePluginClient(conn).Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIds: []string{serial}}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate() = %v", err)
+	}
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	var server *tracetest.SpanStub
+	for i, s := range spans {
+		if s.Name == "v1beta1.DevicePlugin/Allocate" && s.SpanKind == trace.SpanKindServer {
+			server = &spans[i]
+		}
+	}
+	if server == nil {
+		t.Fatalf("no Allocate server span in %d spans", len(spans))
+	}
+	if len(server.Events) == 0 || server.Events[0].Name != "container request" {
+		t.Errorf("Allocate span events = %v, want a container request", server.Events)
+	}
+
+	children := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		if s.Parent.SpanID() == server.SpanContext.SpanID() {
+			children[s.Name] = s
+		}
+	}
+	for _, name := range []string{"hlml.DeviceHandleBySerial", "hlml.MinorNumber", "hlml.ModuleID"} {
+		s, ok := children[name]
+		if !ok {
+			t.Errorf("no %s child span of Allocate", name)
+			continue
+		}
+		if s.SpanContext.TraceID() != server.SpanContext.TraceID() {
+			t.Errorf("%s trace = %s, want %s", name, s.SpanContext.TraceID(), server.SpanContext.TraceID())
+		}
+		want := attribute.String("serial", serial)
+		found := false
+		for _, a := range s.Attributes {
+			found = found || a == want
+		}
+		if !found {
+			t.Errorf("%s attributes = %v, want %v", name, s.Attributes, want)
+		}
+	}
+}
+
+func TestDevicesSpans(t *testing.T) {
+	exporter, tp := installTracerProvider(t)
+	hlml = getHlml()
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devs, err := NewDeviceManager(logs.Logger(), "gaudi").Devices(context.Background())
+	if err != nil {
+		t.Fatalf("Devices() = %v", err)
+	}
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	var parent *tracetest.SpanStub
+	for i, s := range spans {
+		if s.Name == "DeviceManager.Devices" {
+			parent = &spans[i]
+		}
+	}
+	if parent == nil {
+		t.Fatalf("no DeviceManager.Devices span in %d spans", len(spans))
+	}
+	counts := make(map[string]int)
+	for _, s := range spans {
+		if s.Parent.SpanID() == parent.SpanContext.SpanID() {
+			counts[s.Name]++
+		}
+	}
+	// Every HLML call of a device gets its own child span.
+	for _, name := range []string{"hlml.DeviceHandleByIndex", "hlml.PCIID", "hlml.SerialNumber", "hlml.UUID", "hlml.PCIBusID", "hlml.NumaNode"} {
+		if counts[name] != len(devs) {
+			t.Errorf("%d %s child spans, want one per device, %d", counts[name], name, len(devs))
+		}
+	}
+	if counts["hlml.DeviceCount"] != 1 {
+		t.Errorf("%d hlml.DeviceCount child spans, want 1", counts["hlml.DeviceCount"])
+	}
+}
@@ -20,6 +20,6 @@ VERSION ?= 1.16.0
 MINOR_VERSION ?= 526
 DIST ?= ubuntu22.04
 
-GOLANG_VERSION ?= 1.21.5
+GOLANG_VERSION ?= 1.25.5
 
 GIT_COMMIT ?= $(shell git describe --match="" --dirty --long --always --abbrev=40 2> /dev/null || echo "")
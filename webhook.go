@@ -0,0 +1,346 @@
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// nodeSelectorRequirement is a node selector pods requesting devices must
+// set, to any value when value is empty.
+type nodeSelectorRequirement struct {
+	key, value string
+}
+
+func (r nodeSelectorRequirement) String() string {
+	if r.value == "" {
+		return r.key
+	}
+	return r.key + "=" + r.value
+}
+
+// admissionRules are the rules the admission webhook applies to pods
+// requesting devices of resources under prefix.
+type admissionRules struct {
+	prefix string
+
+	// allowedCounts are the device counts a container may request, any
+	// when empty.
+	allowedCounts []int
+	// maxDevices is the most devices a pod may request, unlimited when 0.
+	maxDevices   int
+	nodeSelector []nodeSelectorRequirement
+
+	// setLimits sets the missing device limits of containers to their
+	// requests.
+	setLimits bool
+	// env is added to the containers requesting devices, and tolerations
+	// to the pods, unless already set.
+	env         []corev1.EnvVar
+	tolerations []corev1.Toleration
+}
+
+// newAdmissionRules returns the admission rules configured by cfg.
+func newAdmissionRules(cfg *ClusterConfig) (*admissionRules, error) {
+	r := &admissionRules{prefix: cfg.ResourcePrefix, maxDevices: cfg.WebhookMaxDevices, setLimits: cfg.WebhookSetLimits}
+	var errs []error
+	for f := range strings.SplitSeq(cfg.WebhookAllowedCounts, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("webhookAllowedCounts: invalid count %q", f))
+			continue
+		}
+		r.allowedCounts = append(r.allowedCounts, n)
+	}
+	for f := range strings.SplitSeq(cfg.WebhookNodeSelector, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(f, "=")
+		if msgs := append(validation.IsQualifiedName(key), validation.IsValidLabelValue(value)...); len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("webhookNodeSelector: %q: %s", f, strings.Join(msgs, "; ")))
+			continue
+		}
+		r.nodeSelector = append(r.nodeSelector, nodeSelectorRequirement{key: key, value: value})
+	}
+	for f := range strings.SplitSeq(cfg.WebhookEnv, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(f, "=")
+		if msgs := validation.IsEnvVarName(name); !ok || len(msgs) > 0 {
+			errs = append(errs, fmt.Errorf("webhookEnv: %q must be of the form NAME=value", f))
+			continue
+		}
+		r.env = append(r.env, corev1.EnvVar{Name: name, Value: value})
+	}
+	for f := range strings.SplitSeq(cfg.WebhookTolerations, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		taint, err := parseTaint(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhookTolerations: %q: %w", f, err))
+			continue
+		}
+		t := corev1.Toleration{Key: taint.Key, Operator: corev1.TolerationOpExists, Effect: taint.Effect}
+		if taint.Value != "" {
+			t.Operator, t.Value = corev1.TolerationOpEqual, taint.Value
+		}
+		r.tolerations = append(r.tolerations, t)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// validate returns why pod violates the rules, nothing when it doesn't.
+func (r *admissionRules) validate(pod *corev1.Pod) []string {
+	total := podDevices(pod, r.prefix)
+	if total == 0 {
+		return nil
+	}
+
+	var violations []string
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			if n := containerDevices(c, r.prefix); n > 0 && len(r.allowedCounts) > 0 && !slices.Contains(r.allowedCounts, n) {
+				violations = append(violations, fmt.Sprintf("container %s requests %d Habana devices, allowed counts are %v",
+					c.Name, n, r.allowedCounts))
+			}
+		}
+	}
+	if r.maxDevices > 0 && total > r.maxDevices {
+		violations = append(violations, fmt.Sprintf("pod requests %d Habana devices, at most %d are allowed", total, r.maxDevices))
+	}
+	for _, req := range r.nodeSelector {
+		if value, ok := pod.Spec.NodeSelector[req.key]; !ok || (req.value != "" && value != req.value) {
+			violations = append(violations, fmt.Sprintf("pod requesting Habana devices must set node selector %s", req))
+		}
+	}
+	return violations
+}
+
+// jsonPatchOp is an operation of a JSON patch.
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// mutate returns the JSON patch applying the mutations of the rules to
+// pod, nothing when it doesn't need any.
+func (r *admissionRules) mutate(pod *corev1.Pod) []jsonPatchOp {
+	if podDevices(pod, r.prefix) == 0 {
+		return nil
+	}
+
+	var patch []jsonPatchOp
+	for _, group := range []struct {
+		path       string
+		containers []corev1.Container
+	}{{"/spec/initContainers", pod.Spec.InitContainers}, {"/spec/containers", pod.Spec.Containers}} {
+		for i := range group.containers {
+			c := &group.containers[i]
+			if containerDevices(c, r.prefix) == 0 {
+				continue
+			}
+			path := group.path + "/" + strconv.Itoa(i)
+
+			if r.setLimits {
+				limits := c.Resources.Limits.DeepCopy()
+				for name, q := range c.Resources.Requests {
+					if _, ok := limits[name]; !ok && strings.HasPrefix(string(name), r.prefix) {
+						if limits == nil {
+							limits = make(corev1.ResourceList)
+						}
+						limits[name] = q
+					}
+				}
+				if len(limits) != len(c.Resources.Limits) {
+					patch = append(patch, jsonPatchOp{Op: "add", Path: path + "/resources/limits", Value: limits})
+				}
+			}
+
+			env := slices.Clone(c.Env)
+			for _, v := range r.env {
+				if !slices.ContainsFunc(env, func(e corev1.EnvVar) bool { return e.Name == v.Name }) {
+					env = append(env, v)
+				}
+			}
+			if len(env) != len(c.Env) {
+				patch = append(patch, jsonPatchOp{Op: "add", Path: path + "/env", Value: env})
+			}
+		}
+	}
+
+	tolerations := slices.Clone(pod.Spec.Tolerations)
+	for _, t := range r.tolerations {
+		if !slices.ContainsFunc(tolerations, func(cur corev1.Toleration) bool { return cur.MatchToleration(&t) }) {
+			tolerations = append(tolerations, t)
+		}
+	}
+	if len(tolerations) != len(pod.Spec.Tolerations) {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: "/spec/tolerations", Value: tolerations})
+	}
+	return patch
+}
+
+// admissionWebhook serves the validating and mutating admission webhooks
+// applying rules to pods.
+type admissionWebhook struct {
+	log   *slog.Logger
+	rules *admissionRules
+}
+
+// ServeHTTP answers the AdmissionReviews of the validating webhook on
+// /validate and of the mutating one on /mutate. Objects other than pods
+// are allowed untouched.
+func (w *admissionWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	var pod corev1.Pod
+	if req.Kind.Group == "" && req.Kind.Kind == "Pod" && req.SubResource == "" {
+		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+			http.Error(rw, "invalid pod", http.StatusBadRequest)
+			return
+		}
+		log := w.log.With("namespace", req.Namespace, "pod", cmp.Or(pod.Name, pod.GenerateName), "uid", req.UID)
+
+		switch r.URL.Path {
+		case "/validate":
+			if violations := w.rules.validate(&pod); len(violations) > 0 {
+				resp.Allowed = false
+				resp.Result = &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Code:    http.StatusForbidden,
+					Reason:  metav1.StatusReasonForbidden,
+					Message: strings.Join(violations, "; "),
+				}
+				log.Info("Denied pod", "violations", violations)
+			}
+		case "/mutate":
+			if ops := w.rules.mutate(&pod); len(ops) > 0 {
+				patch, err := json.Marshal(ops)
+				if err != nil {
+					http.Error(rw, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				resp.Patch, resp.PatchType = patch, ptr(admissionv1.PatchTypeJSONPatch)
+				log.Debug("Mutated pod", "patch", string(patch))
+			}
+		default:
+			http.NotFound(rw, r)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(admissionv1.AdmissionReview{TypeMeta: review.TypeMeta, Response: resp})
+}
+
+// certificateReloader serves the TLS certificate of certFile and keyFile,
+// loading them again when certFile changes, as when cert-manager renews
+// the certificate.
+type certificateReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert == nil || !info.ModTime().Equal(c.modTime) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, fmt.Errorf("failed loading webhook certificate: %w", err)
+		}
+		c.cert, c.modTime = &cert, info.ModTime()
+	}
+	return c.cert, nil
+}
+
+// newAdmissionWebhookService returns the admission webhooks served over
+// TLS on cfg.WebhookAddr.
+func newAdmissionWebhookService(log *slog.Logger, cfg *ClusterConfig, _ *kubeClients) (*clusterService, error) {
+	if cfg.WebhookCertFile == "" || cfg.WebhookKeyFile == "" {
+		return nil, errors.New("webhookCertFile and webhookKeyFile must be set to run the admission webhook")
+	}
+	rules, _ := newAdmissionRules(cfg) // validated by load
+	certs := &certificateReloader{certFile: cfg.WebhookCertFile, keyFile: cfg.WebhookKeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	webhook := &admissionWebhook{log: log, rules: rules}
+	mux := http.NewServeMux()
+	mux.Handle("/validate", webhook)
+	mux.Handle("/mutate", webhook)
+	return &clusterService{
+		name:      "admission webhook",
+		addr:      cfg.WebhookAddr,
+		handler:   mux,
+		tlsConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+	}, nil
+}
@@ -0,0 +1,311 @@
+//go:build fakehlml
+
+/*
+ * Copyright (c) 2024, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// newTestWebhook returns the admission webhook configured by change
+// applied to the default cluster configuration.
+func newTestWebhook(t *testing.T, change func(*ClusterConfig)) *admissionWebhook {
+	t.Helper()
+	logs, err := newLogging(io.Discard, logFormatText, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultClusterConfig()
+	change(cfg)
+	rules, err := newAdmissionRules(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionWebhook{log: logs.Logger(), rules: rules}
+}
+
+// review returns an AdmissionReview creating the object of kind, given as
+// JSON.
+func review(kind, object string) string {
+	return `{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind": "AdmissionReview",
+		"request": {
+			"uid": "e911857d-c318-11e8-bbad-025000000001",
+			"kind": {"group": "", "version": "v1", "kind": "` + kind + `"},
+			"namespace": "default",
+			"operation": "CREATE",
+			"object": ` + object + `
+		}
+	}`
+}
+
+// podReview returns an AdmissionReview creating a pod of spec.
+func podReview(spec string) string {
+	return review("Pod", `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "train"}, "spec": `+spec+`}`)
+}
+
+// admit posts body to path of w and returns the response to the review.
+func admit(t *testing.T, w *admissionWebhook, path, body string) *admissionv1.AdmissionResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST %s = %d %s", path, rec.Code, rec.Body)
+	}
+	var out admissionv1.AdmissionReview
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.APIVersion != "admission.k8s.io/v1" || out.Kind != "AdmissionReview" {
+		t.Errorf("review is a %s %s", out.APIVersion, out.Kind)
+	}
+	var in admissionv1.AdmissionReview
+	if err := json.Unmarshal([]byte(body), &in); err != nil {
+		t.Fatal(err)
+	}
+	if out.Response == nil || out.Response.UID != in.Request.UID {
+		t.Fatalf("response %+v doesn't answer request %s", out.Response, in.Request.UID)
+	}
+	return out.Response
+}
+
+func TestAdmissionWebhookValidate(t *testing.T) {
+	w := newTestWebhook(t, func(c *ClusterConfig) {
+		c.WebhookMaxDevices = 8
+		c.WebhookNodeSelector = "habana.ai/device.family=gaudi2,habana.ai/pool"
+	})
+	example, err := os.ReadFile("examples/admission/pod-review.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const selector = `"nodeSelector": {"habana.ai/device.family": "gaudi2", "habana.ai/pool": "a"}`
+
+	for _, tc := range []struct {
+		name, review string
+		// violations are those the pod is denied for, allowed when empty.
+		violations []string
+	}{
+		{
+			name: "allowed counts",
+			review: podReview(`{` + selector + `, "containers": [
+				{"name": "a", "resources": {"limits": {"habana.ai/gaudi": "4"}}},
+				{"name": "b", "resources": {"limits": {"habana.ai/gaudi": "4"}}}
+			]}`),
+		},
+		{
+			name:   "without devices",
+			review: podReview(`{"containers": [{"name": "web", "resources": {"requests": {"cpu": "1"}}}]}`),
+		},
+		{
+			name: "odd count",
+			review: podReview(`{` + selector + `, "containers": [
+				{"name": "worker", "resources": {"limits": {"habana.ai/gaudi": "3"}}},
+				{"name": "single", "resources": {"limits": {"habana.ai/gaudi": "1"}}}
+			]}`),
+			violations: []string{"container worker requests 3 Habana devices, allowed counts are [1 2 4 8]"},
+		},
+		{
+			name: "init container count",
+			review: podReview(`{` + selector + `,
+				"initContainers": [{"name": "setup", "resources": {"limits": {"habana.ai/gaudi": "5"}}}],
+				"containers": [{"name": "worker", "resources": {"limits": {"habana.ai/gaudi": "1"}}}]
+			}`),
+			violations: []string{"container setup requests 5 Habana devices, allowed counts are [1 2 4 8]"},
+		},
+		{
+			name: "per-pod maximum",
+			review: podReview(`{` + selector + `, "containers": [
+				{"name": "a", "resources": {"limits": {"habana.ai/gaudi": "8"}}},
+				{"name": "b", "resources": {"limits": {"habana.ai/gaudi": "2"}}}
+			]}`),
+			violations: []string{"pod requests 10 Habana devices, at most 8 are allowed"},
+		},
+		{
+			name: "node selector",
+			review: podReview(`{"nodeSelector": {"habana.ai/device.family": "gaudi3"}, "containers": [
+				{"name": "worker", "resources": {"limits": {"habana.ai/gaudi": "2"}}}
+			]}`),
+			violations: []string{
+				"pod requesting Habana devices must set node selector habana.ai/device.family=gaudi2",
+				"pod requesting Habana devices must set node selector habana.ai/pool",
+			},
+		},
+		{
+			name:   "example",
+			review: string(example),
+			violations: []string{
+				"container worker requests 3 Habana devices, allowed counts are [1 2 4 8]",
+				"pod requesting Habana devices must set node selector habana.ai/device.family=gaudi2",
+				"pod requesting Habana devices must set node selector habana.ai/pool",
+			},
+		},
+		{
+			name: "not a pod",
+			review: review("Deployment", `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "train"},
+				"spec": {"template": {"spec": {"containers": [{"name": "worker", "resources": {"limits": {"habana.ai/gaudi": "3"}}}]}}}}`),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := admit(t, w, "/validate", tc.review)
+			if len(tc.violations) == 0 {
+				if !resp.Allowed {
+					t.Errorf("denied: %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed {
+				t.Fatal("allowed, want denied")
+			}
+			if resp.Result == nil || resp.Result.Code != http.StatusForbidden {
+				t.Fatalf("result = %+v, want Forbidden", resp.Result)
+			}
+			if want := strings.Join(tc.violations, "; "); resp.Result.Message != want {
+				t.Errorf("message = %q, want %q", resp.Result.Message, want)
+			}
+			if resp.Patch != nil {
+				t.Errorf("validation patched the pod: %s", resp.Patch)
+			}
+		})
+	}
+}
+
+func TestAdmissionWebhookMutate(t *testing.T) {
+	w := newTestWebhook(t, func(c *ClusterConfig) {
+		c.WebhookSetLimits = true
+		c.WebhookEnv = "HABANA_LOGS=/var/log/habana_logs,FOO=ignored"
+		c.WebhookTolerations = "habana.ai/unhealthy:NoSchedule,dedicated=habana:NoExecute"
+	})
+
+	for _, tc := range []struct {
+		name, review string
+		// patch is the JSON patch expected, none when empty.
+		patch string
+	}{
+		{
+			name: "limits, env and tolerations",
+			review: podReview(`{
+				"tolerations": [{"key": "other", "operator": "Exists"}],
+				"containers": [
+					{"name": "sidecar", "resources": {"requests": {"cpu": "1"}}},
+					{"name": "worker", "env": [{"name": "FOO", "value": "bar"}], "resources": {
+						"requests": {"habana.ai/gaudi": "2", "cpu": "8", "memory": "1Gi"},
+						"limits": {"cpu": "8"}
+					}}
+				]
+			}`),
+			patch: `[` +
+				`{"op":"add","path":"/spec/containers/1/resources/limits","value":{"cpu":"8","habana.ai/gaudi":"2"}},` +
+				`{"op":"add","path":"/spec/containers/1/env","value":[{"name":"FOO","value":"bar"},{"name":"HABANA_LOGS","value":"/var/log/habana_logs"}]},` +
+				`{"op":"add","path":"/spec/tolerations","value":[` +
+				`{"key":"other","operator":"Exists"},` +
+				`{"key":"habana.ai/unhealthy","operator":"Exists","effect":"NoSchedule"},` +
+				`{"key":"dedicated","operator":"Equal","value":"habana","effect":"NoExecute"}]}` +
+				`]`,
+		},
+		{
+			name: "init container without env or limits",
+			review: podReview(`{
+				"initContainers": [{"name": "setup", "resources": {"requests": {"habana.ai/gaudi": "1"}}}],
+				"containers": [{"name": "worker", "resources": {"limits": {"habana.ai/gaudi": "1"}}}]
+			}`),
+			patch: `[` +
+				`{"op":"add","path":"/spec/initContainers/0/resources/limits","value":{"habana.ai/gaudi":"1"}},` +
+				`{"op":"add","path":"/spec/initContainers/0/env","value":[{"name":"HABANA_LOGS","value":"/var/log/habana_logs"},{"name":"FOO","value":"ignored"}]},` +
+				`{"op":"add","path":"/spec/containers/0/env","value":[{"name":"HABANA_LOGS","value":"/var/log/habana_logs"},{"name":"FOO","value":"ignored"}]},` +
+				`{"op":"add","path":"/spec/tolerations","value":[` +
+				`{"key":"habana.ai/unhealthy","operator":"Exists","effect":"NoSchedule"},` +
+				`{"key":"dedicated","operator":"Equal","value":"habana","effect":"NoExecute"}]}` +
+				`]`,
+		},
+		{
+			name: "already mutated",
+			review: podReview(`{
+				"tolerations": [
+					{"key": "habana.ai/unhealthy", "operator": "Exists", "effect": "NoSchedule"},
+					{"key": "dedicated", "operator": "Equal", "value": "habana", "effect": "NoExecute"}
+				],
+				"containers": [{"name": "worker",
+					"env": [{"name": "HABANA_LOGS", "value": "/logs"}, {"name": "FOO", "value": "bar"}],
+					"resources": {"requests": {"habana.ai/gaudi": "2"}, "limits": {"habana.ai/gaudi": "2"}}
+				}]
+			}`),
+		},
+		{
+			name:   "without devices",
+			review: podReview(`{"containers": [{"name": "web", "resources": {"requests": {"cpu": "1"}}}]}`),
+		},
+		{
+			name: "not a pod",
+			review: review("Deployment", `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "train"},
+				"spec": {"template": {"spec": {"containers": [{"name": "worker", "resources": {"requests": {"habana.ai/gaudi": "2"}}}]}}}}`),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := admit(t, w, "/mutate", tc.review)
+			if !resp.Allowed {
+				t.Errorf("denied: %v", resp.Result)
+			}
+			if tc.patch == "" {
+				if resp.Patch != nil || resp.PatchType != nil {
+					t.Errorf("patch = %s, want none", resp.Patch)
+				}
+				return
+			}
+			if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Errorf("patch type = %v, want JSONPatch", resp.PatchType)
+			}
+			if string(resp.Patch) != tc.patch {
+				t.Errorf("patch = %s\nwant %s", resp.Patch, tc.patch)
+			}
+		})
+	}
+}
+
+func TestAdmissionWebhookInvalid(t *testing.T) {
+	w := newTestWebhook(t, func(*ClusterConfig) {})
+	pod := podReview(`{"containers": [{"name": "worker"}]}`)
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		code                     int
+	}{
+		{"not JSON", http.MethodPost, "/validate", `{"apiVersion":`, http.StatusBadRequest},
+		{"without request", http.MethodPost, "/mutate", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`, http.StatusBadRequest},
+		{"malformed pod", http.MethodPost, "/validate", review("Pod", `{"spec": {"containers": "worker"}}`), http.StatusBadRequest},
+		{"GET", http.MethodGet, "/validate", "", http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodPost, "/admit", pod, http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+			if rec.Code != tc.code {
+				t.Errorf("%s %s = %d, want %d", tc.method, tc.path, rec.Code, tc.code)
+			}
+		})
+	}
+}